@@ -0,0 +1,310 @@
+package xweb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+//认证方式
+const (
+	AuthRequired = "required" //必须认证,失败返回401
+	AuthOptional = "optional" //可选认证,没有凭证时Principal为nil
+)
+
+var (
+	//ErrAuthRequired 没有认证凭证
+	ErrAuthRequired = errors.New("authentication required")
+	//ErrAuthInvalid 认证凭证无效
+	ErrAuthInvalid = errors.New("authentication invalid")
+	//ErrAuthForbidden 认证成功但没有访问权限,返回403
+	ErrAuthForbidden = errors.New("forbidden")
+	//UseAuth 全局认证器,分发器没有实现IAuthDispatcher时使用
+	UseAuth *Authenticator = nil
+)
+
+//Principal 认证成功的用户,通过*Principal注入
+type Principal struct {
+	//用户id
+	ID string
+	//用户名称
+	Name string
+	//角色
+	Roles []string
+	//权限
+	Perms []string
+	//认证方式 bearer,cookie,session,apikey,basic
+	Scheme string
+	//token声明,使用TokenVerifier时设置
+	Claims *TokenClaims
+	//其他属性
+	Attrs map[string]interface{}
+}
+
+//HasRole 是否有角色
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, v := range p.Roles {
+		if v == role {
+			return true
+		}
+	}
+	return false
+}
+
+//Credential 从请求获取的认证凭证
+type Credential struct {
+	//认证方式
+	Scheme string
+	//token,cookie值,session值或api key
+	Token string
+	//basic认证用户名和密码
+	User     string
+	Password string
+}
+
+//AuthExtractor 从请求获取凭证,没有凭证返回nil
+type AuthExtractor func(c martini.Context, req *http.Request) *Credential
+
+//AuthVerifier 校验凭证,不处理此凭证返回nil,nil
+//返回ErrAuthForbidden输出403,其他错误输出401
+type AuthVerifier func(cred *Credential, req *http.Request) (*Principal, error)
+
+//BearerExtractor 从Authorization: Bearer获取token
+func BearerExtractor() AuthExtractor {
+	return func(c martini.Context, req *http.Request) *Credential {
+		h := req.Header.Get("Authorization")
+		if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+			return &Credential{Scheme: "bearer", Token: strings.TrimSpace(h[7:])}
+		}
+		return nil
+	}
+}
+
+//CookieExtractor 从cookie获取token
+func CookieExtractor(name string) AuthExtractor {
+	return func(c martini.Context, req *http.Request) *Credential {
+		if ck, err := req.Cookie(name); err == nil && ck.Value != "" {
+			return &Credential{Scheme: "cookie", Token: ck.Value}
+		}
+		return nil
+	}
+}
+
+//SessionExtractor 从会话获取用户id,需要先使用sessions.Sessions
+func SessionExtractor(key string) AuthExtractor {
+	return func(c martini.Context, req *http.Request) *Credential {
+		sess := GetSession(c)
+		if sess == nil {
+			return nil
+		}
+		v := sess.Get(key)
+		if v == nil {
+			return nil
+		}
+		return &Credential{Scheme: "session", Token: fmt.Sprintf("%v", v)}
+	}
+}
+
+//APIKeyExtractor 从http头获取api key
+func APIKeyExtractor(header string) AuthExtractor {
+	return func(c martini.Context, req *http.Request) *Credential {
+		if v := req.Header.Get(header); v != "" {
+			return &Credential{Scheme: "apikey", Token: v}
+		}
+		return nil
+	}
+}
+
+//BasicExtractor 获取http basic认证用户名和密码
+func BasicExtractor() AuthExtractor {
+	return func(c martini.Context, req *http.Request) *Credential {
+		if user, pass, ok := req.BasicAuth(); ok {
+			return &Credential{Scheme: "basic", User: user, Password: pass}
+		}
+		return nil
+	}
+}
+
+//是否处理此认证方式,schemes为空处理所有
+func authScheme(cred *Credential, schemes []string) bool {
+	if len(schemes) == 0 {
+		return true
+	}
+	for _, s := range schemes {
+		if s == cred.Scheme {
+			return true
+		}
+	}
+	return false
+}
+
+//DecryptVerifier 使用TokenDecrypt解密token,明文作为用户id
+func DecryptVerifier(schemes ...string) AuthVerifier {
+	return func(cred *Credential, req *http.Request) (*Principal, error) {
+		if cred.Token == "" || !authScheme(cred, schemes) {
+			return nil, nil
+		}
+		id, err := TokenDecrypt(cred.Token)
+		if err != nil || id == "" {
+			return nil, ErrAuthInvalid
+		}
+		return &Principal{ID: id, Scheme: cred.Scheme}, nil
+	}
+}
+
+//TokenVerifier 使用ParseToken校验token,支持加密和JWT模式
+//扩展声明roles和perms作为角色和权限
+func TokenVerifier(opt TokenOptions, schemes ...string) AuthVerifier {
+	return func(cred *Credential, req *http.Request) (*Principal, error) {
+		if cred.Token == "" || !authScheme(cred, schemes) {
+			return nil, nil
+		}
+		c, err := ParseToken(cred.Token, opt)
+		if err != nil {
+			return nil, err
+		}
+		p := &Principal{ID: c.Subject, Scheme: cred.Scheme, Claims: c}
+		p.Roles = claimStrings(c, "roles")
+		p.Perms = claimStrings(c, "perms")
+		return p, nil
+	}
+}
+
+//获取字符串数组声明
+func claimStrings(c *TokenClaims, k string) []string {
+	v, ok := c.Get(k)
+	if !ok {
+		return nil
+	}
+	ret := []string{}
+	switch vv := v.(type) {
+	case []string:
+		ret = append(ret, vv...)
+	case []interface{}:
+		for _, s := range vv {
+			ret = append(ret, fmt.Sprintf("%v", s))
+		}
+	case string:
+		ret = append(ret, strings.Split(vv, ",")...)
+	}
+	return ret
+}
+
+//SessionVerifier 会话中的用户id,fn为nil时直接使用id
+func SessionVerifier(fn func(id string) (*Principal, error)) AuthVerifier {
+	return func(cred *Credential, req *http.Request) (*Principal, error) {
+		if cred.Scheme != "session" {
+			return nil, nil
+		}
+		if fn == nil {
+			return &Principal{ID: cred.Token, Scheme: cred.Scheme}, nil
+		}
+		return fn(cred.Token)
+	}
+}
+
+//BasicVerifier 校验basic认证用户名和密码
+func BasicVerifier(fn func(user string, pass string) (*Principal, error)) AuthVerifier {
+	return func(cred *Credential, req *http.Request) (*Principal, error) {
+		if cred.Scheme != "basic" {
+			return nil, nil
+		}
+		return fn(cred.User, cred.Password)
+	}
+}
+
+//Authenticator 认证器,依次使用提取器获取凭证,由校验器校验
+type Authenticator struct {
+	Extractors []AuthExtractor
+	Verifiers  []AuthVerifier
+	//basic认证失败时输出的WWW-Authenticate realm
+	Realm string
+}
+
+//NewAuthenticator 创建认证器
+func NewAuthenticator(extractors []AuthExtractor, verifiers ...AuthVerifier) *Authenticator {
+	return &Authenticator{Extractors: extractors, Verifiers: verifiers}
+}
+
+//Authenticate 认证请求,没有凭证返回nil,ErrAuthRequired
+//凭证没有校验器处理时继续使用后面的提取器,都没有处理返回ErrAuthInvalid
+//校验器返回错误时直接返回错误
+func (a *Authenticator) Authenticate(c martini.Context, req *http.Request) (*Principal, error) {
+	found := false
+	for _, ex := range a.Extractors {
+		cred := ex(c, req)
+		if cred == nil {
+			continue
+		}
+		found = true
+		for _, vf := range a.Verifiers {
+			p, err := vf(cred, req)
+			if err != nil {
+				return nil, err
+			}
+			if p != nil {
+				if p.Scheme == "" {
+					p.Scheme = cred.Scheme
+				}
+				return p, nil
+			}
+		}
+	}
+	if found {
+		return nil, ErrAuthInvalid
+	}
+	return nil, ErrAuthRequired
+}
+
+//IAuthDispatcher 分发器实现此接口使用独立的认证器,返回nil使用UseAuth
+type IAuthDispatcher interface {
+	Authenticator() *Authenticator
+}
+
+//获取分发器使用的认证器
+func (ctx *HttpContext) dispatcherAuth(c IDispatcher) *Authenticator {
+	if ad, ok := c.(IAuthDispatcher); ok {
+		if a := ad.Authenticator(); a != nil {
+			return a
+		}
+	}
+	return UseAuth
+}
+
+//认证处理,mode为required或optional,iv用于选择错误输出格式
+func (ctx *HttpContext) authHandler(mode string, c IDispatcher, iv IArgs) martini.Handler {
+	if mode != AuthRequired && mode != AuthOptional {
+		panic(fmt.Errorf("auth:\"%s\" not support", mode))
+	}
+	return func(mc martini.Context, mvc IMVC, rw http.ResponseWriter, req *http.Request) {
+		a := ctx.dispatcherAuth(c)
+		if a == nil {
+			panic(errors.New("auth tag need xweb.UseAuth or IAuthDispatcher"))
+		}
+		p, err := a.Authenticate(mc, req)
+		if err == ErrAuthRequired && mode == AuthOptional {
+			mc.Map(p)
+			return
+		}
+		if err == ErrAuthForbidden {
+			ctx.abort(mvc, iv, http.StatusForbidden, err)
+			mvc.SkipAll()
+			return
+		}
+		if err != nil {
+			if a.Realm != "" {
+				rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.Realm))
+			}
+			ctx.abort(mvc, iv, http.StatusUnauthorized, err)
+			mvc.SkipAll()
+			return
+		}
+		mc.Map(p)
+	}
+}
@@ -0,0 +1,202 @@
+package xweb
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+//IPolicy 授权策略
+type IPolicy interface {
+	//Authorize 检查用户是否拥有perms中的所有权限,以及roles中的任意一个角色
+	//拒绝返回ErrAuthForbidden
+	Authorize(p *Principal, perms []string, roles []string, req *http.Request) error
+}
+
+var (
+	//UsePolicy 全局授权策略,分发器没有实现IPolicyDispatcher时使用
+	UsePolicy IPolicy = NewRBAC()
+)
+
+//IPolicyDispatcher 分发器实现此接口使用独立的授权策略
+type IPolicyDispatcher interface {
+	Policy() IPolicy
+}
+
+//RBAC 基于角色的授权,角色对应权限列表
+//权限支持通配符 orders.* 和 *
+type RBAC struct {
+	mu    sync.RWMutex
+	roles map[string][]string
+}
+
+//NewRBAC 创建RBAC,roles为角色对应的权限
+func NewRBAC(roles ...map[string][]string) *RBAC {
+	r := &RBAC{roles: map[string][]string{}}
+	for _, m := range roles {
+		for k, v := range m {
+			r.roles[k] = append(r.roles[k], v...)
+		}
+	}
+	return r
+}
+
+//rbac配置文件格式 {"roles":{"admin":["*"],"clerk":["orders.read"]}}
+type rbacConfig struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+//Load 从json配置加载角色,替换原有配置
+func (r *RBAC) Load(rd io.Reader) error {
+	conf := &rbacConfig{}
+	if err := json.NewDecoder(rd).Decode(conf); err != nil {
+		return err
+	}
+	r.Set(conf.Roles)
+	return nil
+}
+
+//LoadFile 从json配置文件加载角色
+func (r *RBAC) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Load(f)
+}
+
+//Set 设置所有角色权限
+func (r *RBAC) Set(roles map[string][]string) {
+	m := map[string][]string{}
+	for k, v := range roles {
+		m[k] = append([]string{}, v...)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roles = m
+}
+
+//权限是否匹配,支持 * 和 前缀.*
+func permMatch(pattern string, perm string) bool {
+	if pattern == "*" || pattern == perm {
+		return true
+	}
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(perm, pattern[:len(pattern)-1])
+	}
+	return false
+}
+
+//HasPerm 用户直接拥有或通过角色拥有权限
+func (r *RBAC) HasPerm(p *Principal, perm string) bool {
+	for _, v := range p.Perms {
+		if permMatch(v, perm) {
+			return true
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, role := range p.Roles {
+		for _, v := range r.roles[role] {
+			if permMatch(v, perm) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Authorize 实现IPolicy
+func (r *RBAC) Authorize(p *Principal, perms []string, roles []string, req *http.Request) error {
+	if p == nil {
+		return ErrAuthRequired
+	}
+	if len(roles) > 0 {
+		has := false
+		for _, role := range roles {
+			if p.HasRole(role) {
+				has = true
+				break
+			}
+		}
+		if !has {
+			return ErrAuthForbidden
+		}
+	}
+	for _, perm := range perms {
+		if !r.HasPerm(p, perm) {
+			return ErrAuthForbidden
+		}
+	}
+	return nil
+}
+
+//获取分发器使用的授权策略
+func (ctx *HttpContext) dispatcherPolicy(c IDispatcher) IPolicy {
+	if pd, ok := c.(IPolicyDispatcher); ok {
+		if p := pd.Policy(); p != nil {
+			return p
+		}
+	}
+	return UsePolicy
+}
+
+//拆分逗号分隔的tag
+func splitTag(v string) []string {
+	ret := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+//字段的认证和授权要求,用于打印路由
+func authzString(f reflect.StructField) string {
+	ss := []string{}
+	for _, k := range []string{"auth", "role", "perm"} {
+		if v := f.Tag.Get(k); v != "" {
+			ss = append(ss, k+":"+v)
+		}
+	}
+	return strings.Join(ss, " ")
+}
+
+//授权处理,没有认证用户时使用认证器认证
+func (ctx *HttpContext) authzHandler(perms []string, roles []string, c IDispatcher, iv IArgs) martini.Handler {
+	pt := reflect.TypeOf((*Principal)(nil))
+	return func(mc martini.Context, mvc IMVC, req *http.Request) {
+		var p *Principal
+		if pv := mc.Get(pt); pv.IsValid() {
+			p = pv.Interface().(*Principal)
+		} else if a := ctx.dispatcherAuth(c); a != nil {
+			ap, err := a.Authenticate(mc, req)
+			if err == nil {
+				mc.Map(ap)
+				p = ap
+			} else if err == ErrAuthForbidden {
+				ctx.abort(mvc, iv, http.StatusForbidden, err)
+				mvc.SkipAll()
+				return
+			}
+		}
+		err := ctx.dispatcherPolicy(c).Authorize(p, perms, roles, req)
+		if err == nil {
+			return
+		}
+		status := http.StatusForbidden
+		if p == nil || err == ErrAuthRequired {
+			status = http.StatusUnauthorized
+		}
+		ctx.abort(mvc, iv, status, err)
+		mvc.SkipAll()
+	}
+}
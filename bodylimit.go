@@ -0,0 +1,114 @@
+package xweb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+var (
+	//MaxBodySize 默认请求体大小限制,默认0不限制,与旧版本相同
+	//设置后对所有没有maxbody tag的路由生效,包括上传文件的路由,路由使用maxbody tag覆盖
+	MaxBodySize = int64(0)
+	//ErrBodyTooLarge 请求体超过限制
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+//ParseByteSize 解析大小 1024 512KB 1MB 1.5GB,单位不区分大小写,按1024计算
+func ParseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+	mul := float64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mul = strings.TrimSpace(v[:len(v)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("byte size %s format error", s)
+	}
+	return int64(n * mul), nil
+}
+
+//当前请求的请求体限制
+type bodyLimit struct {
+	//原始请求体,嵌套的maxbody重新包装
+	body io.ReadCloser
+	err  error
+}
+
+//记录读取是否超过限制
+type bodyLimitReader struct {
+	io.ReadCloser
+	bl *bodyLimit
+}
+
+func (r *bodyLimitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	var me *http.MaxBytesError
+	if err != nil && errors.As(err, &me) {
+		r.bl.err = ErrBodyTooLarge
+	}
+	return n, err
+}
+
+//设置请求体限制,size<=0不限制
+func setBodyLimit(c martini.Context, rw http.ResponseWriter, req *http.Request, size int64) *bodyLimit {
+	var bl *bodyLimit
+	if bv := c.Get(reflect.TypeOf(bl)); bv.IsValid() {
+		bl = bv.Interface().(*bodyLimit)
+	} else {
+		bl = &bodyLimit{body: req.Body}
+		c.Map(bl)
+	}
+	bl.err = nil
+	if bl.body == nil {
+		return bl
+	}
+	if size <= 0 {
+		req.Body = bl.body
+		return bl
+	}
+	req.Body = &bodyLimitReader{ReadCloser: http.MaxBytesReader(rw, bl.body, size), bl: bl}
+	if req.ContentLength > size {
+		bl.err = ErrBodyTooLarge
+	}
+	return bl
+}
+
+//maxbody tag处理,-不限制
+func maxBodyHandler(tag string) martini.Handler {
+	size := int64(0)
+	if tag != "-" {
+		v, err := ParseByteSize(tag)
+		if err != nil {
+			panic(err)
+		}
+		size = v
+	}
+	return func(c martini.Context, rw http.ResponseWriter, req *http.Request) {
+		setBodyLimit(c, rw, req, size)
+	}
+}
+
+//获取当前请求的请求体限制,没有maxbody tag时使用MaxBodySize
+func (ctx *HttpContext) requestBodyLimit(c martini.Context, rw http.ResponseWriter, req *http.Request) *bodyLimit {
+	if bv := c.Get(reflect.TypeOf((*bodyLimit)(nil))); bv.IsValid() {
+		return bv.Interface().(*bodyLimit)
+	}
+	return setBodyLimit(c, rw, req, MaxBodySize)
+}
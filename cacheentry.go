@@ -0,0 +1,116 @@
+package xweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+)
+
+var (
+	//CacheHeaders 默认保存到缓存的响应头,命中缓存时原样输出
+	CacheHeaders = []string{ContentType, "Content-Language", "Content-Disposition"}
+	//缓存条目标记
+	cacheEntryMagic = []byte("XWE1")
+)
+
+//DefaultCacheable 默认只缓存2xx响应
+func DefaultCacheable(status int) bool {
+	return status >= 200 && status < 300
+}
+
+//CacheEntry 缓存条目,保存http状态,响应头和内容
+type CacheEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+//NewCacheEntry 创建缓存条目
+func NewCacheEntry(status int, header http.Header, body ...[]byte) *CacheEntry {
+	return &CacheEntry{
+		Status: status,
+		Header: header,
+		Body:   bytes.Join(body, nil),
+	}
+}
+
+//Marshal 序列化
+//格式: XWE1 + status(2) + header长度(4) + header json + body
+func (e *CacheEntry) Marshal() ([]byte, error) {
+	hb, err := json.Marshal(e.Header)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(cacheEntryMagic)
+	_ = binary.Write(buf, binary.BigEndian, uint16(e.Status))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(hb)))
+	buf.Write(hb)
+	buf.Write(e.Body)
+	return buf.Bytes(), nil
+}
+
+//UnmarshalCacheEntry 反序列化缓存条目
+//非CacheEntry格式的数据当作状态200的内容处理
+func UnmarshalCacheEntry(b []byte) *CacheEntry {
+	e := &CacheEntry{Status: http.StatusOK, Header: http.Header{}, Body: b}
+	hl := len(cacheEntryMagic)
+	if len(b) < hl+6 || !bytes.Equal(b[:hl], cacheEntryMagic) {
+		return e
+	}
+	status := int(binary.BigEndian.Uint16(b[hl:]))
+	size := int(binary.BigEndian.Uint32(b[hl+2:]))
+	if len(b) < hl+6+size {
+		return e
+	}
+	header := http.Header{}
+	if err := json.Unmarshal(b[hl+6:hl+6+size], &header); err != nil {
+		return e
+	}
+	e.Status = status
+	e.Header = header
+	e.Body = b[hl+6+size:]
+	return e
+}
+
+//IsCacheable 状态是否可以缓存
+func (cp *CacheParams) IsCacheable(status int) bool {
+	if cp.Cacheable != nil {
+		return cp.Cacheable(status)
+	}
+	return DefaultCacheable(status)
+}
+
+//FilterHeader 获取允许缓存的响应头
+func (cp *CacheParams) FilterHeader(h http.Header) http.Header {
+	hs := cp.Headers
+	if hs == nil {
+		hs = CacheHeaders
+	}
+	ret := http.Header{}
+	for _, k := range hs {
+		if vs := h.Values(k); len(vs) > 0 {
+			ret[http.CanonicalHeaderKey(k)] = append([]string{}, vs...)
+		}
+	}
+	return ret
+}
+
+//SetEntry 保存缓存条目
+func (cp *CacheParams) SetEntry(e *CacheEntry) error {
+	bb, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	return cp.SetBytes(bb)
+}
+
+//GetEntry 获取缓存条目
+func (cp *CacheParams) GetEntry() (*CacheEntry, error) {
+	bb, err := cp.GetBytes()
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalCacheEntry(bb), nil
+}
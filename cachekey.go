@@ -0,0 +1,169 @@
+package xweb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	//CacheKeyVersion 缓存key版本,发布时修改版本号可以让旧缓存全部失效
+	CacheKeyVersion = "v1"
+	//CacheKeyTag 参与生成缓存key的参数字段tag cache:"key"
+	CacheKeyTag = "cache"
+)
+
+//CacheKeyOption 缓存key组成部分,返回名称和值
+type CacheKeyOption func(req *http.Request) (string, string)
+
+//KeyMethod http方法参与生成key
+func KeyMethod() CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "method", req.Method
+	}
+}
+
+//KeyPath 请求路径参与生成key
+func KeyPath() CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "path", req.URL.Path
+	}
+}
+
+//KeyQuery 排序后的查询参数参与生成key
+func KeyQuery() CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "query", req.URL.Query().Encode()
+	}
+}
+
+//KeyHeader http头参与生成key
+func KeyHeader(name string) CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "header." + http.CanonicalHeaderKey(name), strings.Join(req.Header.Values(name), ",")
+	}
+}
+
+//KeyCookie cookie参与生成key,可用于会话id
+func KeyCookie(name string) CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		if c, err := req.Cookie(name); err == nil {
+			return "cookie." + name, c.Value
+		}
+		return "cookie." + name, ""
+	}
+}
+
+//KeyLocale 语言参与生成key,取Accept-Language第一个语言
+func KeyLocale() CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		lang := req.Header.Get("Accept-Language")
+		if i := strings.IndexAny(lang, ",;"); i >= 0 {
+			lang = lang[:i]
+		}
+		return "locale", strings.ToLower(strings.TrimSpace(lang))
+	}
+}
+
+//KeyUser 用户标识参与生成key,fn从请求获取用户id
+func KeyUser(fn func(req *http.Request) string) CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "user", fn(req)
+	}
+}
+
+//KeyValue 固定值参与生成key
+func KeyValue(name string, v interface{}) CacheKeyOption {
+	return func(req *http.Request) (string, string) {
+		return "value." + name, fmt.Sprintf("%v", v)
+	}
+}
+
+//CacheKey 缓存key生成器
+//生成格式: 命名空间:版本:sha256(参数类型+cache:"key"字段+选项)
+type CacheKey struct {
+	//命名空间
+	Namespace string
+	//版本,为空使用CacheKeyVersion
+	Version string
+	opts    []CacheKeyOption
+}
+
+//NewCacheKey 创建缓存key生成器
+func NewCacheKey(ns string, opts ...CacheKeyOption) *CacheKey {
+	return &CacheKey{Namespace: ns, opts: opts}
+}
+
+//获取参数中cache:"key"标记的字段
+func cacheKeyFields(v reflect.Value, parts []string) []string {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return parts
+	}
+	vt := v.Type()
+	for i := 0; i < vt.NumField(); i++ {
+		tf := vt.Field(i)
+		sf := v.Field(i)
+		tag := tf.Tag.Get(CacheKeyTag)
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			if tf.Anonymous {
+				parts = cacheKeyFields(sf, parts)
+			}
+			continue
+		}
+		if !sf.CanInterface() {
+			continue
+		}
+		//json序列化保证指针和map输出稳定
+		jv, err := json.Marshal(sf.Interface())
+		if err != nil {
+			jv = []byte(fmt.Sprintf("%v", sf.Interface()))
+		}
+		parts = append(parts, "args."+tf.Name+"="+string(jv))
+	}
+	return parts
+}
+
+//Parts 获取参与生成key的所有数据
+func (k *CacheKey) Parts(args IArgs, req *http.Request) []string {
+	parts := []string{}
+	if args != nil {
+		parts = append(parts, "type="+reflect.TypeOf(args).String())
+		parts = cacheKeyFields(reflect.ValueOf(args), parts)
+	}
+	ops := []string{}
+	for _, opt := range k.opts {
+		n, v := opt(req)
+		ops = append(ops, n+"="+v)
+	}
+	sort.Strings(ops)
+	return append(parts, ops...)
+}
+
+//Build 生成缓存key
+func (k *CacheKey) Build(args IArgs, req *http.Request) string {
+	ver := k.Version
+	if ver == "" {
+		ver = CacheKeyVersion
+	}
+	h := sha256.New()
+	for _, p := range k.Parts(args, req) {
+		_, _ = h.Write([]byte(p))
+		_, _ = h.Write([]byte{0})
+	}
+	return k.Namespace + ":" + ver + ":" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+//Params 创建使用此key的缓存参数
+func (k *CacheKey) Params(imp ICache, ttl time.Duration, dtl time.Duration, args IArgs, req *http.Request) *CacheParams {
+	return NewCacheParams(imp, ttl, dtl, "%s", k.Build(args, req))
+}
@@ -0,0 +1,154 @@
+package xweb
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+//缓存事件类型
+const (
+	CacheEventHit         = iota //命中缓存
+	CacheEventMiss               //未命中,需要执行获取数据
+	CacheEventStale              //获取锁失败,返回旧数据
+	CacheEventLockWait           //等待其他请求释放锁
+	CacheEventLockTimeout        //等待锁超时
+	CacheEventCompress           //数据压缩
+	CacheEventSetError           //保存缓存失败
+	CacheEventWaitHit            //等待锁期间其他请求保存了数据
+	cacheEventCount
+)
+
+var (
+	cacheEventNames = [cacheEventCount]string{
+		CacheEventHit:         "hit",
+		CacheEventMiss:        "miss",
+		CacheEventStale:       "stale",
+		CacheEventLockWait:    "lock_wait",
+		CacheEventLockTimeout: "lock_timeout",
+		CacheEventCompress:    "compress",
+		CacheEventSetError:    "set_error",
+		CacheEventWaitHit:     "wait_hit",
+	}
+)
+
+//CacheEventName 获取事件名称
+func CacheEventName(typ int) string {
+	if typ < 0 || typ >= cacheEventCount {
+		return "unknown"
+	}
+	return cacheEventNames[typ]
+}
+
+//CacheEvent 缓存事件
+type CacheEvent struct {
+	//事件类型
+	Type int
+	//缓存key
+	Key string
+	//压缩前数据大小
+	Size int
+	//压缩后数据大小
+	ZipSize int
+	//压缩编码
+	Codec byte
+	//错误信息
+	Err error
+}
+
+//Ratio 压缩率,压缩后大小/压缩前大小
+func (ev *CacheEvent) Ratio() float64 {
+	if ev.Size == 0 {
+		return 0
+	}
+	return float64(ev.ZipSize) / float64(ev.Size)
+}
+
+//ICacheObserver 缓存事件观察者,实现需要并发安全
+type ICacheObserver interface {
+	OnCacheEvent(ev *CacheEvent)
+}
+
+var (
+	//CacheObserver 全局缓存事件观察者,CacheParams.Observer未设置时使用
+	CacheObserver ICacheObserver = nil
+)
+
+//CacheStats 默认进程内缓存统计
+type CacheStats struct {
+	events  [cacheEventCount]int64
+	size    int64
+	zipsize int64
+}
+
+//NewCacheStats 创建缓存统计
+func NewCacheStats() *CacheStats {
+	return &CacheStats{}
+}
+
+//OnCacheEvent 统计事件
+func (s *CacheStats) OnCacheEvent(ev *CacheEvent) {
+	if ev.Type < 0 || ev.Type >= cacheEventCount {
+		return
+	}
+	atomic.AddInt64(&s.events[ev.Type], 1)
+	if ev.Type == CacheEventCompress {
+		atomic.AddInt64(&s.size, int64(ev.Size))
+		atomic.AddInt64(&s.zipsize, int64(ev.ZipSize))
+	}
+}
+
+//Count 获取事件次数
+func (s *CacheStats) Count(typ int) int64 {
+	if typ < 0 || typ >= cacheEventCount {
+		return 0
+	}
+	return atomic.LoadInt64(&s.events[typ])
+}
+
+//HitRatio 命中率,命中,等待锁后命中和返回旧数据都作为命中
+func (s *CacheStats) HitRatio() float64 {
+	hit := s.Count(CacheEventHit) + s.Count(CacheEventWaitHit) + s.Count(CacheEventStale)
+	total := hit + s.Count(CacheEventMiss)
+	if total == 0 {
+		return 0
+	}
+	return float64(hit) / float64(total)
+}
+
+//Ratio 平均压缩率
+func (s *CacheStats) Ratio() float64 {
+	size := atomic.LoadInt64(&s.size)
+	if size == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&s.zipsize)) / float64(size)
+}
+
+//Snapshot 获取所有统计数据
+func (s *CacheStats) Snapshot() map[string]int64 {
+	m := map[string]int64{}
+	for i := 0; i < cacheEventCount; i++ {
+		m[CacheEventName(i)] = s.Count(i)
+	}
+	m["compress_bytes"] = atomic.LoadInt64(&s.size)
+	m["compress_zip_bytes"] = atomic.LoadInt64(&s.zipsize)
+	return m
+}
+
+//ServeHTTP 以prometheus文本格式输出统计数据
+//xweb.Get("/metrics/cache", stats.ServeHTTP)
+func (s *CacheStats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(ContentType, "text/plain; version=0.0.4")
+	_, _ = fmt.Fprintln(w, "# TYPE xweb_cache_events_total counter")
+	for i := 0; i < cacheEventCount; i++ {
+		_, _ = fmt.Fprintf(w, "xweb_cache_events_total{event=%q} %d\n", CacheEventName(i), s.Count(i))
+	}
+	_, _ = fmt.Fprintln(w, "# TYPE xweb_cache_hit_ratio gauge")
+	_, _ = fmt.Fprintf(w, "xweb_cache_hit_ratio %g\n", s.HitRatio())
+	_, _ = fmt.Fprintln(w, "# TYPE xweb_cache_compress_bytes_total counter")
+	_, _ = fmt.Fprintf(w, "xweb_cache_compress_bytes_total{kind=\"raw\"} %d\n", atomic.LoadInt64(&s.size))
+	_, _ = fmt.Fprintf(w, "xweb_cache_compress_bytes_total{kind=\"zip\"} %d\n", atomic.LoadInt64(&s.zipsize))
+	_, _ = fmt.Fprintln(w, "# TYPE xweb_cache_compress_ratio gauge")
+	_, _ = fmt.Fprintf(w, "xweb_cache_compress_ratio %g\n", s.Ratio())
+}
@@ -0,0 +1,197 @@
+package xweb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cxuhua/lzma"
+)
+
+//缓存数据压缩编码id,保存在缓存数据第一个字节
+//0,1 兼容旧版本SetBytes保存的数据,其他方式保存的数据GetBytes原样返回
+const (
+	CodecNone   = byte(0) //不压缩
+	CodecLZMA   = byte(1) //lzma压缩,压缩率高速度慢
+	CodecGzip   = byte(2) //gzip压缩
+	CodecFlate  = byte(3) //flate快速压缩,适合热点数据
+	CodecZstd   = byte(4) //保留给zstd实现,需要自行注册
+	CodecSnappy = byte(5) //snappy块格式快速压缩
+)
+
+//ICodec 缓存数据压缩编码器
+type ICodec interface {
+	//ID 编码id,0-255
+	ID() byte
+	//Encode 压缩数据
+	Encode(b []byte) ([]byte, error)
+	//Decode 解压数据
+	Decode(b []byte) ([]byte, error)
+}
+
+var (
+	//DefaultCodec 未设置CacheParams.Codec时使用的压缩编码器
+	DefaultCodec ICodec = lzmaCodec{}
+	codecs              = map[byte]ICodec{}
+	codecslck           = sync.RWMutex{}
+)
+
+//RegisterCodec 注册压缩编码器,相同id将覆盖
+func RegisterCodec(c ICodec) {
+	codecslck.Lock()
+	defer codecslck.Unlock()
+	codecs[c.ID()] = c
+}
+
+//GetCodec 获取注册的压缩编码器
+func GetCodec(id byte) (ICodec, bool) {
+	codecslck.RLock()
+	defer codecslck.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+type noneCodec struct {
+}
+
+func (c noneCodec) ID() byte {
+	return CodecNone
+}
+
+func (c noneCodec) Encode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (c noneCodec) Decode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+type lzmaCodec struct {
+}
+
+func (c lzmaCodec) ID() byte {
+	return CodecLZMA
+}
+
+func (c lzmaCodec) Encode(b []byte) ([]byte, error) {
+	return lzma.Compress(b)
+}
+
+func (c lzmaCodec) Decode(b []byte) ([]byte, error) {
+	return lzma.Uncompress(b)
+}
+
+type gzipCodec struct {
+}
+
+func (c gzipCodec) ID() byte {
+	return CodecGzip
+}
+
+func (c gzipCodec) Encode(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type flateCodec struct {
+}
+
+func (c flateCodec) ID() byte {
+	return CodecFlate
+}
+
+func (c flateCodec) Encode(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCodec) Decode(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+//NoneCodec 不压缩
+func NoneCodec() ICodec {
+	return noneCodec{}
+}
+
+//LZMACodec lzma压缩
+func LZMACodec() ICodec {
+	return lzmaCodec{}
+}
+
+//GzipCodec gzip压缩
+func GzipCodec() ICodec {
+	return gzipCodec{}
+}
+
+//FlateCodec flate快速压缩
+func FlateCodec() ICodec {
+	return flateCodec{}
+}
+
+//编码数据,第一个字节存放编码id
+func encodeWithCodec(c ICodec, sb []byte) ([]byte, error) {
+	zb, err := c.Encode(sb)
+	if err != nil {
+		return nil, err
+	}
+	vb := make([]byte, len(zb)+1)
+	vb[0] = c.ID()
+	copy(vb[1:], zb)
+	return vb, nil
+}
+
+//解码数据,与旧版本相同,编码id为0,1以外并且不能解码的数据认为不是SetBytes保存的,原样返回
+func decodeWithCodec(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty content")
+	}
+	c, ok := GetCodec(b[0])
+	if !ok {
+		return b, nil
+	}
+	v, err := c.Decode(b[1:])
+	if err != nil && b[0] != CodecNone && b[0] != CodecLZMA {
+		return b, nil
+	}
+	return v, err
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(lzmaCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(flateCodec{})
+	RegisterCodec(snappyCodec{})
+}
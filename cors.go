@@ -0,0 +1,214 @@
+package xweb
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+//CORS相关头
+const (
+	HeaderOrigin           = "Origin"
+	HeaderAllowOrigin      = "Access-Control-Allow-Origin"
+	HeaderAllowCredentials = "Access-Control-Allow-Credentials"
+	HeaderAllowMethods     = "Access-Control-Allow-Methods"
+	HeaderAllowHeaders     = "Access-Control-Allow-Headers"
+	HeaderExposeHeaders    = "Access-Control-Expose-Headers"
+	HeaderMaxAge           = "Access-Control-Max-Age"
+	HeaderRequestMethod    = "Access-Control-Request-Method"
+	HeaderRequestHeaders   = "Access-Control-Request-Headers"
+	corsRegexPrefix        = "re:"
+)
+
+//CORSOptions 跨域配置
+type CORSOptions struct {
+	//允许的来源
+	//* 所有来源
+	//https://*.example.com 通配符,*不匹配/
+	//re:^https://(a|b)\.example\.com$ 正则表达式
+	AllowOrigins []string
+	//允许的方法,为空使用路由中该路径的所有方法
+	AllowMethods []string
+	//允许的请求头,为空使用预检请求的Access-Control-Request-Headers
+	AllowHeaders []string
+	//允许客户端读取的响应头
+	ExposeHeaders []string
+	//是否允许携带cookie
+	AllowCredentials bool
+	//预检结果缓存时间
+	MaxAge time.Duration
+}
+
+//编译后的来源匹配
+type corsOrigin struct {
+	any   bool
+	exact map[string]bool
+	regs  []*regexp.Regexp
+}
+
+func newCORSOrigin(origins []string) *corsOrigin {
+	co := &corsOrigin{exact: map[string]bool{}}
+	for _, o := range origins {
+		switch {
+		case o == "*":
+			co.any = true
+		case strings.HasPrefix(o, corsRegexPrefix):
+			co.regs = append(co.regs, regexp.MustCompile(o[len(corsRegexPrefix):]))
+		case strings.Contains(o, "*"):
+			ps := strings.Split(strings.ToLower(o), "*")
+			for i, p := range ps {
+				ps[i] = regexp.QuoteMeta(p)
+			}
+			co.regs = append(co.regs, regexp.MustCompile("^"+strings.Join(ps, "[^/]*")+"$"))
+		default:
+			co.exact[strings.ToLower(o)] = true
+		}
+	}
+	return co
+}
+
+func (co *corsOrigin) match(origin string) bool {
+	if co.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if co.exact[origin] {
+		return true
+	}
+	for _, r := range co.regs {
+		if r.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+//分组配置
+type corsGroup struct {
+	prefix string
+	opt    CORSOptions
+	origin *corsOrigin
+}
+
+//CORS 跨域处理,支持按路径前缀覆盖配置
+type CORS struct {
+	mu     sync.RWMutex
+	groups []*corsGroup
+	def    *corsGroup
+}
+
+//NewCORS 创建跨域处理
+func NewCORS(opt CORSOptions) *CORS {
+	return &CORS{def: &corsGroup{opt: opt, origin: newCORSOrigin(opt.AllowOrigins)}}
+}
+
+//获取路径使用的配置,最长前缀优先
+func (cs *CORS) lookup(path string) *corsGroup {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, g := range cs.groups {
+		if strings.HasPrefix(path, g.prefix) {
+			return g
+		}
+	}
+	return cs.def
+}
+
+//Group 设置路径前缀的配置,返回的处理可以用于HttpContext.Group
+//预检请求没有对应的路由,由Handler按前缀选择配置
+//	cors := xweb.NewCORS(opt)
+//	ctx.Use(cors.Handler())
+//	ctx.Group("/open", fn, cors.Group("/open", openOpt))
+func (cs *CORS) Group(prefix string, opt CORSOptions) martini.Handler {
+	g := &corsGroup{prefix: prefix, opt: opt, origin: newCORSOrigin(opt.AllowOrigins)}
+	cs.mu.Lock()
+	cs.groups = append(cs.groups, g)
+	sort.SliceStable(cs.groups, func(i, j int) bool {
+		return len(cs.groups[i].prefix) > len(cs.groups[j].prefix)
+	})
+	cs.mu.Unlock()
+	return func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get(HeaderOrigin)
+		if origin != "" && g.origin.match(origin) {
+			g.setOrigin(w.Header(), origin)
+		}
+	}
+}
+
+//设置允许来源和凭证
+func (g *corsGroup) setOrigin(h http.Header, origin string) {
+	addVary(h, HeaderOrigin)
+	if g.origin.any && !g.opt.AllowCredentials {
+		h.Set(HeaderAllowOrigin, "*")
+	} else {
+		h.Set(HeaderAllowOrigin, origin)
+	}
+	if g.opt.AllowCredentials {
+		h.Set(HeaderAllowCredentials, "true")
+	}
+	if len(g.opt.ExposeHeaders) > 0 {
+		h.Set(HeaderExposeHeaders, strings.Join(g.opt.ExposeHeaders, ", "))
+	}
+}
+
+//处理预检请求
+func (g *corsGroup) preflight(routes martini.Routes, w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	addVary(h, HeaderOrigin, HeaderRequestMethod, HeaderRequestHeaders)
+	methods := g.opt.AllowMethods
+	if len(methods) == 0 {
+		methods = routes.MethodsFor(req.URL.Path)
+	}
+	if len(methods) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g.setOrigin(h, req.Header.Get(HeaderOrigin))
+	h.Del(HeaderExposeHeaders)
+	h.Set(HeaderAllowMethods, strings.Join(methods, ", "))
+	if len(g.opt.AllowHeaders) > 0 {
+		h.Set(HeaderAllowHeaders, strings.Join(g.opt.AllowHeaders, ", "))
+	} else if rh := req.Header.Get(HeaderRequestHeaders); rh != "" {
+		h.Set(HeaderAllowHeaders, rh)
+	}
+	if g.opt.MaxAge > 0 {
+		h.Set(HeaderMaxAge, strconv.Itoa(int(g.opt.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Handler 全局跨域处理,用于HttpContext.Use
+func (cs *CORS) Handler() martini.Handler {
+	return func(routes martini.Routes, w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get(HeaderOrigin)
+		if origin == "" {
+			return
+		}
+		g := cs.lookup(req.URL.Path)
+		ispre := req.Method == http.MethodOptions && req.Header.Get(HeaderRequestMethod) != ""
+		if !g.origin.match(origin) {
+			if ispre {
+				addVary(w.Header(), HeaderOrigin)
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return
+		}
+		if !ispre {
+			g.setOrigin(w.Header(), origin)
+			return
+		}
+		g.preflight(routes, w, req)
+	}
+}
+
+//CORSHandler 使用配置创建全局跨域处理
+//	ctx.Use(xweb.CORSHandler(xweb.CORSOptions{AllowOrigins: []string{"https://*.example.com"}}))
+func CORSHandler(opt CORSOptions) martini.Handler {
+	return NewCORS(opt).Handler()
+}
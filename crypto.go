@@ -1,21 +1,49 @@
 package xweb
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cxuhua/xweb/martini"
 )
 
+//内置默认token密钥,生产环境不能使用
+const defaultTokenKey = "BM9dkmHWcJAqalwiuylIX4HcDElwDd7uauDsdWr646v"
+
 var (
-	TokenKey      []byte       = []byte("BM9dkmHWcJAqalwiuylIX4HcDElwDd7uauDsdWr646v")
+	//TokenKey 未设置TokenKeyring时使用的token密钥,同时用于解密旧版本CBC token
+	TokenKey      []byte       = []byte(defaultTokenKey)
 	tokenAesBlock cipher.Block = nil
+	//TokenKeyring token密钥环,设置后使用第一个KeyActive状态的密钥加密,通过密钥id选择解密密钥
+	TokenKeyring *Keyring = nil
+	//TokenLegacy 是否接受旧版本AES-CBC token,默认接受已经签发的旧版本token
+	//旧版本token没有完整性校验,迁移完成后关闭或者设置TokenLegacyUntil
+	TokenLegacy = true
+	//TokenLegacyUntil 迁移截止时间,不为0时超过此时间不再接受旧版本token
+	TokenLegacyUntil time.Time
+	//ErrDefaultTokenKey 生产环境使用了内置默认token密钥
+	ErrDefaultTokenKey = errors.New("production can't use default TokenKey, set xweb.TokenKey or xweb.TokenKeyring")
+	//ErrTokenInvalid token解密或校验失败
+	ErrTokenInvalid = errors.New("token invalid")
+	//ErrDecryptPadding 解密后填充错误
+	ErrDecryptPadding = errors.New("decrypt padding error")
+)
+
+//token版本,保存在token第一个字节
+const (
+	tokenVersionGCM = byte(2) //version(1)+keyid长度(1)+keyid+nonce(12)+密文+tag(16)
 )
 
 func HMACString(data, secret string) string {
@@ -103,14 +131,27 @@ func AesDecryptWithIV(block cipher.Block, data []byte, iv []byte) ([]byte, error
 	dd := data[0:]
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(dd, dd)
+	return aesUnpad(dd)
+}
+
+//去掉填充,填充错误返回ErrDecryptPadding
+//旧版本加密数据长度为块大小整数倍时没有填充,最后一个字节大于块大小时认为没有填充
+func aesUnpad(dd []byte) ([]byte, error) {
 	l := len(dd)
-	if n := dd[l-1]; n <= aes.BlockSize {
-		x := l - int(n)
-		if bytesEquInt(dd[x:], n) {
-			dd = dd[:x]
-		}
+	if l == 0 {
+		return nil, ErrDecryptPadding
 	}
-	return dd, nil
+	n := dd[l-1]
+	if n == 0 {
+		return nil, ErrDecryptPadding
+	}
+	if n > aes.BlockSize {
+		return dd, nil
+	}
+	if !bytesEquInt(dd[l-int(n):], n) {
+		return nil, ErrDecryptPadding
+	}
+	return dd[:l-int(n)], nil
 }
 
 // AES加密
@@ -123,11 +164,9 @@ func AesEncrypt(block cipher.Block, data []byte) ([]byte, error) {
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return nil, err
 	}
+	//总是填充,长度为块大小整数倍时填充一个完整的块
 	dl := len(data)
 	l := (dl/aes.BlockSize)*aes.BlockSize + aes.BlockSize
-	if dl%aes.BlockSize == 0 {
-		l = dl
-	}
 	//add iv length
 	dd := make([]byte, l+aes.BlockSize)
 	n := l - dl
@@ -158,14 +197,7 @@ func AesDecrypt(block cipher.Block, data []byte) ([]byte, error) {
 	dd := data[aes.BlockSize:]
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(dd, dd)
-	l := len(dd)
-	if n := dd[l-1]; n <= aes.BlockSize {
-		x := l - int(n)
-		if bytesEquInt(dd[x:], n) {
-			dd = dd[:x]
-		}
-	}
-	return dd, nil
+	return aesUnpad(dd)
 }
 
 //动态创建编码器
@@ -203,25 +235,176 @@ func TokenDecrypt(value string) (string, error) {
 	return string(s), nil
 }
 
-//token加密
-func BytesEncrypt(b []byte) ([]byte, error) {
-	if err := makeTokenAesBlock(); err != nil {
+//CheckTokenKey 生产环境没有设置TokenKeyring并且使用默认TokenKey返回错误
+func CheckTokenKey() error {
+	if martini.Env != martini.Prod || TokenKeyring != nil {
+		return nil
+	}
+	if bytes.Equal(TokenKey, []byte(defaultTokenKey)) {
+		return ErrDefaultTokenKey
+	}
+	return nil
+}
+
+//获取加密token使用的密钥,没有设置TokenKeyring使用TokenKey,id为空
+func tokenEncryptKey() (*SignKey, error) {
+	if TokenKeyring == nil {
+		return &SignKey{Secret: TokenKey}, nil
+	}
+	return TokenKeyring.Active()
+}
+
+//获取解密token使用的密钥
+func tokenDecryptKey(id string) (*SignKey, error) {
+	if TokenKeyring == nil {
+		if id != "" {
+			return nil, ErrSignKey
+		}
+		return &SignKey{Secret: TokenKey}, nil
+	}
+	key, ok := TokenKeyring.Get(id)
+	if !ok || key.State == KeyRetired {
+		return nil, ErrSignKey
+	}
+	return key, nil
+}
+
+//token密钥最少字节数
+const tokenKeyMinSize = 16
+
+//使用HKDF-SHA256从密钥派生AES-256密钥,不足tokenKeyMinSize的密钥返回ErrSignKey
+func tokenGCMKey(secret []byte) ([]byte, error) {
+	if len(secret) < tokenKeyMinSize {
+		return nil, ErrSignKey
+	}
+	//extract
+	mac := hmac.New(sha256.New, []byte("xweb token"))
+	mac.Write(secret)
+	//expand,只需要一个块
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write([]byte("aes-256-gcm"))
+	mac.Write([]byte{1})
+	return mac.Sum(nil), nil
+}
+
+//创建AES-GCM
+func newTokenGCM(key *SignKey) (cipher.AEAD, error) {
+	ikey, err := tokenGCMKey(key.Secret)
+	if err != nil {
 		return nil, err
 	}
-	d, err := AesEncrypt(tokenAesBlock, b)
+	block, err := aes.NewCipher(ikey)
 	if err != nil {
 		return nil, err
 	}
-	return d, nil
+	return cipher.NewGCM(block)
 }
 
-//token解密
-func BytesDecrypt(b []byte) ([]byte, error) {
+//AES-GCM加密,版本和密钥id作为附加数据参与校验
+func gcmTokenEncrypt(key *SignKey, b []byte) ([]byte, error) {
+	if len(key.ID) > 255 {
+		return nil, errors.New("token key id too long")
+	}
+	aead, err := newTokenGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	head := append([]byte{tokenVersionGCM, byte(len(key.ID))}, key.ID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dd := append(append([]byte{}, head...), nonce...)
+	return aead.Seal(dd, nonce, b, head), nil
+}
+
+//版本和密钥id都匹配的数据认为是GCM token,解密失败不再尝试CBC
+//旧版本token的随机iv只有极小概率匹配
+func isGCMToken(b []byte) bool {
+	if len(b) < 2 || b[0] != tokenVersionGCM || len(b) < 2+int(b[1]) {
+		return false
+	}
+	id := string(b[2 : 2+int(b[1])])
+	if TokenKeyring == nil {
+		return id == ""
+	}
+	_, ok := TokenKeyring.Get(id)
+	return ok
+}
+
+//AES-GCM解密
+func gcmTokenDecrypt(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != tokenVersionGCM {
+		return nil, ErrTokenInvalid
+	}
+	hl := 2 + int(b[1])
+	if len(b) < hl {
+		return nil, ErrTokenInvalid
+	}
+	key, err := tokenDecryptKey(string(b[2:hl]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newTokenGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < hl+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrTokenInvalid
+	}
+	nonce := b[hl : hl+aead.NonceSize()]
+	s, err := aead.Open(nil, nonce, b[hl+aead.NonceSize():], b[:hl])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	return s, nil
+}
+
+//token加密,使用AES-GCM
+func BytesEncrypt(b []byte) ([]byte, error) {
+	key, err := tokenEncryptKey()
+	if err != nil {
+		return nil, err
+	}
+	return gcmTokenEncrypt(key, b)
+}
+
+//是否在迁移期间接受旧版本token
+func tokenLegacyEnabled() bool {
+	return TokenLegacy && (TokenLegacyUntil.IsZero() || time.Now().Before(TokenLegacyUntil))
+}
+
+//旧版本AES-CBC解密,严格检查填充
+//旧版本数据长度为块大小整数倍时没有填充,这时要求内容为文本
+func legacyTokenDecrypt(b []byte) ([]byte, error) {
 	if err := makeTokenAesBlock(); err != nil {
 		return nil, err
 	}
-	s, err := AesDecrypt(tokenAesBlock, b)
+	if len(b) < 2*aes.BlockSize || len(b)%aes.BlockSize != 0 {
+		return nil, ErrTokenInvalid
+	}
+	dd := make([]byte, len(b)-aes.BlockSize)
+	mode := cipher.NewCBCDecrypter(tokenAesBlock, b[:aes.BlockSize])
+	mode.CryptBlocks(dd, b[aes.BlockSize:])
+	s, err := aesUnpad(dd)
 	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if len(s) == len(dd) && !utf8.Valid(s) {
+		return nil, ErrTokenInvalid
+	}
+	return s, nil
+}
+
+//token解密,TokenLegacy开启并且在TokenLegacyUntil之前,GCM解密失败时尝试旧版本CBC解密
+//旧版本token没有完整性校验,迁移完成后需要关闭
+func BytesDecrypt(b []byte) ([]byte, error) {
+	s, err := gcmTokenDecrypt(b)
+	if err == nil || !tokenLegacyEnabled() || isGCMToken(b) {
+		return s, err
+	}
+	s, lerr := legacyTokenDecrypt(b)
+	if lerr != nil {
 		return nil, err
 	}
 	return s, nil
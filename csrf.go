@@ -0,0 +1,260 @@
+package xweb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+var (
+	//ErrCSRFMissing 请求没有csrf token
+	ErrCSRFMissing = errors.New("csrf token missing")
+	//ErrCSRFInvalid csrf token校验失败
+	ErrCSRFInvalid = errors.New("csrf token invalid")
+)
+
+//CSRFOptions csrf配置
+type CSRFOptions struct {
+	//会话中保存secret的key,默认_csrf,使用sessions.Sessions时保存在会话中
+	SessionKey string
+	//没有会话时保存secret的签名cookie,默认_csrf
+	CookieName string
+	//cookie签名密钥,为空使用TokenKey
+	CookieSecret []byte
+	//cookie路径,默认/
+	CookiePath string
+	//cookie是否只在https发送
+	CookieSecure bool
+	//表单字段名称,默认_csrf
+	FieldName string
+	//http头名称,默认X-CSRF-Token
+	HeaderName string
+	//JSON和XML参数是否校验,默认不校验
+	CheckJSON bool
+	//校验失败的处理,为nil输出403 CSRFModel
+	Failure func(mvc IMVC, err error)
+}
+
+//CSRFModel csrf校验失败输出的模型
+type CSRFModel struct {
+	HTTPModel
+}
+
+//NewCSRFModel 创建csrf失败模型
+func NewCSRFModel(err error) *CSRFModel {
+	m := &CSRFModel{}
+	m.Code = http.StatusForbidden
+	m.Error = err.Error()
+	return m
+}
+
+//CSRF csrf保护,使用Handler映射*CSRFState到请求上下文
+type CSRF struct {
+	opt CSRFOptions
+}
+
+//NewCSRF 创建csrf保护
+func NewCSRF(opts ...CSRFOptions) *CSRF {
+	opt := CSRFOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.SessionKey == "" {
+		opt.SessionKey = "_csrf"
+	}
+	if opt.CookieName == "" {
+		opt.CookieName = "_csrf"
+	}
+	if opt.CookiePath == "" {
+		opt.CookiePath = "/"
+	}
+	if opt.FieldName == "" {
+		opt.FieldName = "_csrf"
+	}
+	if opt.HeaderName == "" {
+		opt.HeaderName = "X-CSRF-Token"
+	}
+	return &CSRF{opt: opt}
+}
+
+//CSRFState 当前请求的csrf状态
+type CSRFState struct {
+	cs     *CSRF
+	secret []byte
+}
+
+//secret和salt生成token
+func csrfMask(secret []byte, salt []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(salt)
+	return base64.RawURLEncoding.EncodeToString(append(append([]byte{}, salt...), mac.Sum(nil)[:16]...))
+}
+
+//Token 生成token,每次调用使用不同的salt
+func (st *CSRFState) Token() string {
+	salt := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		panic(err)
+	}
+	return csrfMask(st.secret, salt)
+}
+
+//Field 生成隐藏表单字段
+func (st *CSRFState) Field() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(st.cs.opt.FieldName) + `" value="` + st.Token() + `">`)
+}
+
+//Verify 校验token
+func (st *CSRFState) Verify(token string) error {
+	if token == "" {
+		return ErrCSRFMissing
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 24 {
+		return ErrCSRFInvalid
+	}
+	if !hmac.Equal([]byte(csrfMask(st.secret, b[:8])), []byte(token)) {
+		return ErrCSRFInvalid
+	}
+	return nil
+}
+
+//签名cookie值 base64(secret).base64(hmac)
+func (cs *CSRF) signCookie(secret []byte) string {
+	key := cs.opt.CookieSecret
+	if key == nil {
+		key = TokenKey
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(secret)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(secret) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func (cs *CSRF) parseCookie(v string) []byte {
+	i := strings.Index(v, ".")
+	if i < 0 {
+		return nil
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(v[:i])
+	if err != nil || len(secret) != 32 {
+		return nil
+	}
+	if !hmac.Equal([]byte(cs.signCookie(secret)), []byte(v)) {
+		return nil
+	}
+	return secret
+}
+
+//获取或创建secret,优先使用会话
+func (cs *CSRF) secret(c martini.Context, w http.ResponseWriter, req *http.Request) ([]byte, error) {
+	sess := GetSession(c)
+	if sess != nil {
+		if s, ok := sess.Get(cs.opt.SessionKey).(string); ok {
+			if b, err := base64.RawURLEncoding.DecodeString(s); err == nil && len(b) == 32 {
+				return b, nil
+			}
+		}
+	} else if ck, err := req.Cookie(cs.opt.CookieName); err == nil {
+		if b := cs.parseCookie(ck.Value); b != nil {
+			return b, nil
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	if sess != nil {
+		sess.Set(cs.opt.SessionKey, base64.RawURLEncoding.EncodeToString(secret))
+	} else {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cs.opt.CookieName,
+			Value:    cs.signCookie(secret),
+			Path:     cs.opt.CookiePath,
+			Secure:   cs.opt.CookieSecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return secret, nil
+}
+
+//Handler 映射*CSRFState,需要在sessions.Sessions之后使用
+//	ctx.Use(xweb.NewCSRF().Handler())
+func (cs *CSRF) Handler() martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, req *http.Request) {
+		secret, err := cs.secret(c, w, req)
+		if err != nil {
+			panic(err)
+		}
+		c.Map(&CSRFState{cs: cs, secret: secret})
+	}
+}
+
+//模版函数获取csrf状态
+func csrfStateFunc(c martini.Context) (*CSRFState, error) {
+	sv := c.Get(reflect.TypeOf((*CSRFState)(nil)))
+	if !sv.IsValid() || sv.IsNil() {
+		return nil, errors.New("csrf not use, ctx.Use(xweb.NewCSRF().Handler())")
+	}
+	return sv.Interface().(*CSRFState), nil
+}
+
+//是否是安全方法
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+//从请求获取token,http头优先
+//FORM参数绑定时已经解析表单,其他参数只解析urlencoded数据,读取受请求体限制
+func (st *CSRFState) requestToken(req *http.Request) string {
+	if v := req.Header.Get(st.cs.opt.HeaderName); v != "" {
+		return v
+	}
+	if req.Form == nil {
+		_ = req.ParseForm()
+	}
+	return req.Form.Get(st.cs.opt.FieldName)
+}
+
+//参数绑定后校验csrf,没有使用CSRF.Handler时不校验
+func (ctx *HttpContext) checkCSRF(c martini.Context, mvc IMVC, iv IArgs, req *http.Request) bool {
+	sv := c.Get(reflect.TypeOf((*CSRFState)(nil)))
+	if !sv.IsValid() || sv.IsNil() || csrfSafeMethod(req.Method) {
+		return true
+	}
+	st := sv.Interface().(*CSRFState)
+	if rt := iv.ReqType(); (rt == AT_JSON || rt == AT_XML) && !st.cs.opt.CheckJSON {
+		return true
+	}
+	err := st.Verify(st.requestToken(req))
+	if err == nil {
+		return true
+	}
+	if st.cs.opt.Failure != nil {
+		st.cs.opt.Failure(mvc, err)
+	} else {
+		m := NewCSRFModel(err)
+		mvc.SetStatus(http.StatusForbidden)
+		mvc.SetModel(m)
+		if iv.ReqType() == AT_XML {
+			mvc.SetRender(XML_RENDER)
+		} else {
+			mvc.SetRender(JSON_RENDER)
+		}
+	}
+	return false
+}
@@ -165,21 +165,39 @@ type HTTPClient struct {
 	http.Client
 	IsSecure bool
 	Host     string
-	ctx      context.Context
+	//请求签名器原型,发送前签名
+	Signer ISigner
+	//是否校验响应签名,需要设置Signer
+	VerifyResponse bool
+	//发送前依次调用,在签名之前执行
+	OnRequest []func(req *http.Request) error
+	ctx       context.Context
 }
 
 var (
 	NoDataError = errors.New("http not response data")
 )
 
+//SignMismatchError 响应签名校验失败
+type SignMismatchError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *SignMismatchError) Error() string {
+	return fmt.Sprintf("http response sign mismatch,status=%d: %v", e.StatusCode, e.Err)
+}
+
+func (e *SignMismatchError) Unwrap() error {
+	return e.Err
+}
+
 func (this HTTPClient) GetBytes(path string) (HttpResponse, error) {
-	ret := HttpResponse{}
-	res, err := this.Client.Get(this.Host + path)
+	req, err := this.request(http.MethodGet, this.Host+path, nil)
 	if err != nil {
-		return ret, err
+		return HttpResponse{}, err
 	}
-	ret.Response = res
-	return ret, nil
+	return this.Do(req)
 }
 
 func HttpForm(url string, q HTTPValues) (HttpResponse, error) {
@@ -204,23 +222,11 @@ func HttpGet(url string) (HttpResponse, error) {
 }
 
 func (this HTTPClient) Get(path string, q HTTPValues) (HttpResponse, error) {
-	ret := HttpResponse{}
-	url, err := url.Parse(path)
-	if err != nil {
-		return ret, err
-	}
-	qv := url.Query()
-	for kv, vv := range q.Values {
-		for _, v := range vv {
-			qv.Add(kv, v)
-		}
-	}
-	res, err := this.Client.Get(this.Host + url.Path + "?" + qv.Encode())
+	req, err := this.NewGet(path, q)
 	if err != nil {
-		return ret, err
+		return HttpResponse{}, err
 	}
-	ret.Response = res
-	return ret, nil
+	return this.Do(req)
 }
 
 func (this HTTPClient) PostBytes(path string, ct string, data []byte) (HttpResponse, error) {
@@ -228,23 +234,19 @@ func (this HTTPClient) PostBytes(path string, ct string, data []byte) (HttpRespo
 }
 
 func (this HTTPClient) Post(path string, ct string, body io.Reader) (HttpResponse, error) {
-	ret := HttpResponse{}
-	res, err := this.Client.Post(this.Host+path, ct, body)
+	req, err := this.NewPost(path, ct, body)
 	if err != nil {
-		return ret, err
+		return HttpResponse{}, err
 	}
-	ret.Response = res
-	return ret, nil
+	return this.Do(req)
 }
 
 func (this HTTPClient) Form(path string, v HTTPValues) (HttpResponse, error) {
-	ret := HttpResponse{}
-	res, err := this.Client.PostForm(this.Host+path, v.Values)
+	req, err := this.NewForm(path, v)
 	if err != nil {
-		return ret, err
+		return HttpResponse{}, err
 	}
-	ret.Response = res
-	return ret, nil
+	return this.Do(req)
 }
 
 //自动识别是否启用context
@@ -279,7 +281,7 @@ func (this HTTPClient) NewForm(path string, v HTTPValues) (*http.Request, error)
 	body := strings.NewReader(v.Encode())
 	req, err := this.request(http.MethodPost, this.Host+path, body)
 	if err != nil {
-		return req, nil
+		return nil, err
 	}
 	req.Header.Set(ContentType, ContentURLEncoded)
 	return req, nil
@@ -299,7 +301,7 @@ func dialTimeout(ctx context.Context,network, addr string) (net.Conn, error) {
 func (this HTTPClient) NewPost(path string, bt string, body io.Reader) (*http.Request, error) {
 	req, err := this.request(http.MethodPost, this.Host+path, body)
 	if err != nil {
-		return req, nil
+		return nil, err
 	}
 	if bt != "" {
 		req.Header.Set(ContentType, bt)
@@ -307,14 +309,65 @@ func (this HTTPClient) NewPost(path string, bt string, body io.Reader) (*http.Re
 	return req, nil
 }
 
+//签名请求,读取body签名后重新设置
+func (this HTTPClient) signRequest(req *http.Request) error {
+	if this.Signer == nil {
+		return nil
+	}
+	sg := this.Signer.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		data, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		req.ContentLength = int64(len(data))
+		if err := sg.Write(data); err != nil {
+			return err
+		}
+	}
+	return SignWithSigner(sg, req.Header, req, 0)
+}
+
+//校验响应签名,读取body校验后重新设置
+func (this HTTPClient) verifyResponse(req *http.Request, res *http.Response) error {
+	if this.Signer == nil || !this.VerifyResponse {
+		return nil
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err := VerifyWithSigner(this.Signer.New(), res.Header, data, req, res.StatusCode); err != nil {
+		return &SignMismatchError{StatusCode: res.StatusCode, Err: err}
+	}
+	return nil
+}
+
+//Do 发送请求,依次执行OnRequest,签名请求,设置VerifyResponse时校验响应签名
+//响应签名校验失败返回*SignMismatchError,同时返回响应
 func (this HTTPClient) Do(req *http.Request) (HttpResponse, error) {
 	ret := HttpResponse{}
+	for _, fn := range this.OnRequest {
+		if err := fn(req); err != nil {
+			return ret, err
+		}
+	}
+	if err := this.signRequest(req); err != nil {
+		return ret, err
+	}
 	res, err := this.Client.Do(req)
 	if err != nil {
 		return ret, err
 	}
 	ret.Response = res
-	return ret, nil
+	return ret, this.verifyResponse(req, res)
 }
 
 //not verify config
@@ -155,6 +155,8 @@ type URLS struct {
 	View    string
 	Render  string
 	Args    IArgs
+	//认证和授权要求,包含上级分组的要求
+	Authz string
 }
 type HttpContext struct {
 	martini.ClassicMartini
@@ -163,6 +165,15 @@ type HttpContext struct {
 	heapPPROFFiles []string
 	cpuPPROFFiles  []string
 	http           *http.Server
+	//注册路由时上级分组的认证和授权要求
+	authzs []string
+	//注册路由时上级分组路径
+	groups []string
+	//http.Server超时设置,为0不限制
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
 }
 
 func (this *HttpContext) InitDefaultLogger(w io.Writer) {
@@ -247,25 +258,37 @@ func (this *HttpContext) Shutdown() {
 	_ = this.http.Shutdown(ctx)
 }
 
+//创建http服务,使用配置的超时
+func (this *HttpContext) newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           this,
+		ReadTimeout:       this.ReadTimeout,
+		ReadHeaderTimeout: this.ReadHeaderTimeout,
+		WriteTimeout:      this.WriteTimeout,
+		IdleTimeout:       this.IdleTimeout,
+	}
+}
+
 func (this *HttpContext) ListenAndServe(addr string) error {
+	if err := CheckTokenKey(); err != nil {
+		return err
+	}
 	this.PrintURLS()
 	this.Logger().Infof("http listening on %s (%s)\n", addr, martini.Env)
 
-	this.http = &http.Server{
-		Addr:    addr,
-		Handler: this,
-	}
+	this.http = this.newServer(addr)
 	return this.http.ListenAndServe()
 }
 
 func (this *HttpContext) ListenAndServeTLS(addr string, cert, key string) error {
+	if err := CheckTokenKey(); err != nil {
+		return err
+	}
 	this.PrintURLS()
 	this.Logger().Infof("https listening on %s (%s)\n", addr, martini.Env)
 
-	this.http = &http.Server{
-		Addr:    addr,
-		Handler: this,
-	}
+	this.http = this.newServer(addr)
 	return this.http.ListenAndServeTLS(cert, key)
 }
 
@@ -292,9 +315,9 @@ func (this *HttpContext) PrintURLS() {
 			rc = len(u.Render)
 		}
 	}
-	fs := fmt.Sprintf("+ %%-%ds %%-%ds %%-%ds %%-%ds\n", mc, pc, vc, rc)
+	fs := fmt.Sprintf("+ %%-%ds %%-%ds %%-%ds %%-%ds %%s\n", mc, pc, vc, rc)
 	for _, u := range this.URLS {
-		logv.Infof(fs, u.Method, u.Pattern, u.View, u.Render)
+		logv.Infof(fs, u.Method, u.Pattern, u.View, u.Render, u.Authz)
 	}
 }
 
@@ -347,6 +370,8 @@ func NewHttpContextWithFS(dir string, fs http.FileSystem, staticOpt ...martini.S
 	m.Use(martini.StaticFS(dir, staticFS, staticOpt...))
 	m.MapTo(r, (*martini.Routes)(nil))
 	m.Action(r.Handle)
+	h.ReadHeaderTimeout = time.Second * 10
+	h.IdleTimeout = time.Second * 120
 	h.Validator = NewValidator()
 	h.URLS = []URLS{}
 	h.Martini = m
@@ -363,6 +388,8 @@ func NewHttpContext(fs ...http.FileSystem) *HttpContext {
 	m.Use(martini.Static("public"))
 	m.MapTo(r, (*martini.Routes)(nil))
 	m.Action(r.Handle)
+	h.ReadHeaderTimeout = time.Second * 10
+	h.IdleTimeout = time.Second * 120
 	h.Validator = NewValidator()
 	h.URLS = []URLS{}
 	h.Martini = m
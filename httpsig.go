@@ -0,0 +1,418 @@
+package xweb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RFC 9421 http消息签名,RFC 9530 Content-Digest
+
+//http消息签名头
+const (
+	HeaderSignature      = "Signature"
+	HeaderSignatureInput = "Signature-Input"
+	HeaderContentDigest  = "Content-Digest"
+)
+
+var (
+	//HTTPSignLabel 签名标签
+	HTTPSignLabel = "sig1"
+	//HTTPSignRequestComponents 请求签名包含的组件
+	HTTPSignRequestComponents = []string{"@method", "@authority", "@path", "@query", "content-digest"}
+	//HTTPSignResponseComponents 响应签名包含的组件,;req表示从对应的请求获取
+	HTTPSignResponseComponents = []string{"@status", "content-digest", "@method;req", "@authority;req", "@path;req"}
+	//ErrSignHeader 签名器只能通过http头签名和验证
+	ErrSignHeader = errors.New("signer only support header sign, use SignWithSigner")
+)
+
+//签名组件
+type httpSigComponent struct {
+	name string
+	req  bool
+}
+
+func (c httpSigComponent) String() string {
+	s := strconv.Quote(c.name)
+	if c.req {
+		s += ";req"
+	}
+	return s
+}
+
+//解析 @method;req 格式的组件
+func parseSigComponent(s string) httpSigComponent {
+	c := httpSigComponent{}
+	if i := strings.Index(s, ";"); i >= 0 {
+		c.req = s[i+1:] == "req"
+		s = s[:i]
+	}
+	c.name = strings.ToLower(s)
+	return c
+}
+
+//签名参数
+type httpSigParams struct {
+	comps   []httpSigComponent
+	created int64
+	expires int64
+	keyid   string
+	alg     string
+	nonce   string
+	//原始字符串,验证时使用
+	raw string
+}
+
+func (p *httpSigParams) String() string {
+	if p.raw != "" {
+		return p.raw
+	}
+	cs := []string{}
+	for _, c := range p.comps {
+		cs = append(cs, c.String())
+	}
+	s := "(" + strings.Join(cs, " ") + ")"
+	if p.created > 0 {
+		s += ";created=" + strconv.FormatInt(p.created, 10)
+	}
+	if p.expires > 0 {
+		s += ";expires=" + strconv.FormatInt(p.expires, 10)
+	}
+	if p.keyid != "" {
+		s += ";keyid=" + strconv.Quote(p.keyid)
+	}
+	if p.alg != "" {
+		s += ";alg=" + strconv.Quote(p.alg)
+	}
+	if p.nonce != "" {
+		s += ";nonce=" + strconv.Quote(p.nonce)
+	}
+	return s
+}
+
+//按顶层逗号拆分结构化字段字典
+func splitSFDict(s string) map[string]string {
+	ret := map[string]string{}
+	depth, quote, start := 0, false, 0
+	add := func(item string) {
+		item = strings.TrimSpace(item)
+		if i := strings.Index(item, "="); i > 0 {
+			ret[strings.TrimSpace(item[:i])] = strings.TrimSpace(item[i+1:])
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\\' && quote:
+			i++
+		case ch == '"':
+			quote = !quote
+		case ch == '(' && !quote:
+			depth++
+		case ch == ')' && !quote:
+			depth--
+		case ch == ',' && !quote && depth == 0:
+			add(s[start:i])
+			start = i + 1
+		}
+	}
+	add(s[start:])
+	return ret
+}
+
+//解析Signature-Input中的签名参数
+func parseSigParams(s string) (*httpSigParams, error) {
+	p := &httpSigParams{raw: s}
+	if !strings.HasPrefix(s, "(") {
+		return nil, ErrSignInvalid
+	}
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, ErrSignInvalid
+	}
+	for _, item := range strings.Fields(s[1:end]) {
+		vs := strings.Split(item, ";")
+		name, err := strconv.Unquote(vs[0])
+		if err != nil {
+			return nil, ErrSignInvalid
+		}
+		c := httpSigComponent{name: name}
+		for _, pv := range vs[1:] {
+			if pv != "req" {
+				return nil, fmt.Errorf("sign component param %s not support", pv)
+			}
+			c.req = true
+		}
+		p.comps = append(p.comps, c)
+	}
+	for _, pv := range strings.Split(s[end+1:], ";") {
+		kv := strings.SplitN(strings.TrimSpace(pv), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if uv, err := strconv.Unquote(v); err == nil {
+			v = uv
+		}
+		switch kv[0] {
+		case "created":
+			p.created, _ = strconv.ParseInt(v, 10, 64)
+		case "expires":
+			p.expires, _ = strconv.ParseInt(v, 10, 64)
+		case "keyid":
+			p.keyid = v
+		case "alg":
+			p.alg = v
+		case "nonce":
+			p.nonce = v
+		}
+	}
+	return p, nil
+}
+
+//ContentDigest 生成Content-Digest头 sha-256=:base64:
+func ContentDigest(body []byte) string {
+	bb := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(bb[:]) + ":"
+}
+
+//校验Content-Digest,支持sha-256和sha-512
+func checkContentDigest(v string, body []byte) error {
+	if v == "" {
+		return ErrSignEmpty
+	}
+	for alg, dv := range splitSFDict(v) {
+		var sum []byte
+		switch alg {
+		case "sha-256":
+			bb := sha256.Sum256(body)
+			sum = bb[:]
+		case "sha-512":
+			bb := sha512.Sum512(body)
+			sum = bb[:]
+		default:
+			continue
+		}
+		if dv == ":"+base64.StdEncoding.EncodeToString(sum)+":" {
+			return nil
+		}
+		return ErrSignInvalid
+	}
+	return ErrSignInvalid
+}
+
+//获取组件值
+func httpSigValue(c httpSigComponent, h http.Header, req *http.Request, status int) (string, error) {
+	if c.req && status == 0 {
+		return "", fmt.Errorf("sign component %s;req only for response", c.name)
+	}
+	if !strings.HasPrefix(c.name, "@") {
+		hh := h
+		if c.req {
+			hh = req.Header
+		}
+		vs := hh.Values(c.name)
+		if len(vs) == 0 {
+			return "", fmt.Errorf("sign component %s miss", c.name)
+		}
+		for i, v := range vs {
+			vs[i] = strings.TrimSpace(v)
+		}
+		return strings.Join(vs, ", "), nil
+	}
+	scheme := "http"
+	if req.TLS != nil || req.URL.Scheme == "https" {
+		scheme = "https"
+	}
+	switch c.name {
+	case "@status":
+		if status == 0 || c.req {
+			return "", errors.New("sign component @status only for response")
+		}
+		return strconv.Itoa(status), nil
+	case "@method":
+		return req.Method, nil
+	case "@authority":
+		return strings.ToLower(req.Host), nil
+	case "@scheme":
+		return scheme, nil
+	case "@path":
+		if p := req.URL.EscapedPath(); p != "" {
+			return p, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + req.URL.RawQuery, nil
+	case "@request-target":
+		return req.URL.RequestURI(), nil
+	case "@target-uri":
+		return scheme + "://" + strings.ToLower(req.Host) + req.URL.RequestURI(), nil
+	}
+	return "", fmt.Errorf("sign component %s not support", c.name)
+}
+
+//生成签名基础字符串
+func httpSigBase(p *httpSigParams, h http.Header, req *http.Request, status int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, c := range p.comps {
+		v, err := httpSigValue(c, h, req, status)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(c.String() + ": " + v + "\n")
+	}
+	buf.WriteString(`"@signature-params": ` + p.String())
+	return buf.Bytes(), nil
+}
+
+//RFC 9421签名器,通过keyid从密钥环选择密钥
+type httpsigner struct {
+	kr     *Keyring
+	buf    *bytes.Buffer
+	replay SignReplay
+}
+
+func (hs *httpsigner) New() ISigner {
+	return &httpsigner{kr: hs.kr, buf: &bytes.Buffer{}, replay: hs.replay}
+}
+
+func (hs *httpsigner) Write(data []byte) error {
+	_, err := hs.buf.Write(data)
+	return err
+}
+
+//Create 签名信息需要多个http头,只能通过SignWithSigner签名
+func (hs *httpsigner) Create(ads ...string) (string, string, string, error) {
+	return "", "", "", ErrSignHeader
+}
+
+//Verify 签名信息需要多个http头,只能通过VerifyWithSigner验证
+func (hs *httpsigner) Verify(data []byte, sign string, ts string, nonce string, ads ...string) error {
+	return ErrSignHeader
+}
+
+func (hs *httpsigner) SignHeader(h http.Header, req *http.Request, status int) error {
+	key, err := hs.kr.Active()
+	if err != nil {
+		return err
+	}
+	cs := HTTPSignRequestComponents
+	if status != 0 {
+		cs = HTTPSignResponseComponents
+	}
+	p := &httpSigParams{
+		created: time.Now().Unix(),
+		keyid:   key.ID,
+		alg:     key.alg(),
+		nonce:   RandStr(),
+	}
+	for _, c := range cs {
+		p.comps = append(p.comps, parseSigComponent(c))
+	}
+	h.Set(HeaderContentDigest, ContentDigest(hs.buf.Bytes()))
+	base, err := httpSigBase(p, h, req, status)
+	if err != nil {
+		return err
+	}
+	sign, err := key.SignBytes(base)
+	if err != nil {
+		return err
+	}
+	h.Set(HeaderSignatureInput, HTTPSignLabel+"="+p.String())
+	h.Set(HeaderSignature, HTTPSignLabel+"=:"+base64.StdEncoding.EncodeToString(sign)+":")
+	return nil
+}
+
+func (hs *httpsigner) VerifyHeader(h http.Header, data []byte, req *http.Request, status int) error {
+	inputs := splitSFDict(h.Get(HeaderSignatureInput))
+	signs := splitSFDict(h.Get(HeaderSignature))
+	//使用第一个同时存在签名和参数的标签
+	label := HTTPSignLabel
+	if _, has := inputs[label]; !has {
+		label = ""
+		for k := range inputs {
+			if _, has := signs[k]; has {
+				label = k
+				break
+			}
+		}
+	}
+	input, sv := inputs[label], signs[label]
+	if input == "" || sv == "" {
+		return ErrSignEmpty
+	}
+	p, err := parseSigParams(input)
+	if err != nil {
+		return err
+	}
+	sign, err := base64.StdEncoding.DecodeString(strings.Trim(sv, ":"))
+	if err != nil {
+		return ErrSignInvalid
+	}
+	//有消息体时必须签名content-digest
+	digest := false
+	for _, c := range p.comps {
+		if c.name == "content-digest" && !c.req {
+			digest = true
+		}
+	}
+	if len(data) > 0 && !digest {
+		return ErrSignInvalid
+	}
+	if digest {
+		if err := checkContentDigest(h.Get(HeaderContentDigest), data); err != nil {
+			return err
+		}
+	}
+	var key *SignKey
+	if p.keyid == "" {
+		key, err = hs.kr.Active()
+	} else if k, ok := hs.kr.Get(p.keyid); ok {
+		key = k
+	} else {
+		err = ErrSignKey
+	}
+	if err != nil {
+		return err
+	}
+	if key.State == KeyRetired || (p.alg != "" && p.alg != key.alg()) {
+		return ErrSignKey
+	}
+	if p.expires > 0 && time.Now().Unix() > p.expires {
+		return ErrSignExpired
+	}
+	ttl, err := hs.replay.checkTimestamp(strconv.FormatInt(p.created, 10))
+	if err != nil {
+		return err
+	}
+	base, err := httpSigBase(p, h, req, status)
+	if err != nil {
+		return err
+	}
+	if err := key.VerifyBytes(base, sign); err != nil {
+		return err
+	}
+	if p.nonce == "" {
+		if hs.replay.Nonces != nil {
+			return ErrSignEmpty
+		}
+		return nil
+	}
+	return hs.replay.checkNonce(p.nonce, ttl)
+}
+
+//NewHTTPSigner 创建RFC 9421 http消息签名器,支持hmac-sha256和ed25519
+//签名使用第一个KeyActive状态的密钥,验证通过keyid参数选择密钥
+func NewHTTPSigner(kr *Keyring, replay ...SignReplay) ISigner {
+	hs := &httpsigner{kr: kr, buf: &bytes.Buffer{}}
+	if len(replay) > 0 {
+		hs.replay = replay[0]
+	}
+	return hs
+}
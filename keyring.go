@@ -0,0 +1,343 @@
+package xweb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//签名密钥状态
+const (
+	KeyActive     = iota //可签名和验证,多个时使用第一个签名
+	KeyVerifyOnly        //只用于验证,轮换时旧密钥过渡使用
+	KeyRetired           //已停用,验证失败
+)
+
+//签名算法
+const (
+	SignAlgSHA256     = "sha256"      //兼容NewStandSigner sha256(data+key)
+	SignAlgHMACSHA256 = "hmac-sha256" //hmac-sha256
+	SignAlgHMACSHA512 = "hmac-sha512" //hmac-sha512
+	SignAlgEd25519    = "ed25519"     //ed25519公私钥签名
+)
+
+//SignKey 签名密钥
+type SignKey struct {
+	//密钥id,通过NF-Key-Id头传递
+	ID string
+	//签名算法,为空使用SignAlgHMACSHA256
+	Alg string
+	//密钥状态
+	State int
+	//hmac和sha256算法使用的密钥
+	Secret []byte
+	//ed25519私钥,只验证时可以为空
+	PrivateKey ed25519.PrivateKey
+	//ed25519公钥,为空时从私钥获取
+	PublicKey ed25519.PublicKey
+}
+
+func (k *SignKey) alg() string {
+	if k.Alg == "" {
+		return SignAlgHMACSHA256
+	}
+	return k.Alg
+}
+
+func (k *SignKey) hmac(fn func() hash.Hash, data []byte) []byte {
+	mac := hmac.New(fn, k.Secret)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k *SignKey) publicKey() ed25519.PublicKey {
+	if k.PublicKey == nil && len(k.PrivateKey) == ed25519.PrivateKeySize {
+		return k.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	return k.PublicKey
+}
+
+//SignBytes 签名数据,返回原始签名
+func (k *SignKey) SignBytes(data []byte) ([]byte, error) {
+	switch k.alg() {
+	case SignAlgSHA256:
+		bb := sha256.Sum256(append(append([]byte{}, data...), k.Secret...))
+		return bb[:], nil
+	case SignAlgHMACSHA256:
+		return k.hmac(sha256.New, data), nil
+	case SignAlgHMACSHA512:
+		return k.hmac(sha512.New, data), nil
+	case SignAlgEd25519:
+		if len(k.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("key %s ed25519 private key miss", k.ID)
+		}
+		return ed25519.Sign(k.PrivateKey, data), nil
+	}
+	return nil, fmt.Errorf("key %s alg %s not support", k.ID, k.Alg)
+}
+
+//VerifyBytes 验证原始签名
+func (k *SignKey) VerifyBytes(data []byte, sign []byte) error {
+	if k.alg() == SignAlgEd25519 {
+		pub := k.publicKey()
+		if len(pub) != ed25519.PublicKeySize {
+			return ErrSignKey
+		}
+		if !ed25519.Verify(pub, data, sign) {
+			return ErrSignInvalid
+		}
+		return nil
+	}
+	ssg, err := k.SignBytes(data)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(ssg, sign) {
+		return ErrSignInvalid
+	}
+	return nil
+}
+
+//Sign 签名数据,返回hex编码的签名
+func (k *SignKey) Sign(data []byte) (string, error) {
+	sb, err := k.SignBytes(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sb), nil
+}
+
+//Verify 验证hex编码的签名
+func (k *SignKey) Verify(data []byte, sign string) error {
+	sb, err := hex.DecodeString(sign)
+	if err != nil {
+		return ErrSignInvalid
+	}
+	return k.VerifyBytes(data, sb)
+}
+
+//Keyring 签名密钥环,并发安全
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]*SignKey
+	order  []string
+	loader func() ([]*SignKey, error)
+}
+
+//NewKeyring 创建密钥环
+func NewKeyring(keys ...*SignKey) *Keyring {
+	kr := &Keyring{}
+	kr.Set(keys...)
+	return kr
+}
+
+//Set 替换所有密钥
+func (kr *Keyring) Set(keys ...*SignKey) {
+	m := map[string]*SignKey{}
+	order := []string{}
+	for _, k := range keys {
+		if _, has := m[k.ID]; !has {
+			order = append(order, k.ID)
+		}
+		m[k.ID] = k
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = m
+	kr.order = order
+}
+
+//Get 获取密钥
+func (kr *Keyring) Get(id string) (*SignKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	k, ok := kr.keys[id]
+	return k, ok
+}
+
+//Active 获取用于签名的密钥
+func (kr *Keyring) Active() (*SignKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, id := range kr.order {
+		if k := kr.keys[id]; k.State == KeyActive {
+			return k, nil
+		}
+	}
+	return nil, ErrSignKey
+}
+
+//OnReload 设置密钥加载函数,Reload时调用
+func (kr *Keyring) OnReload(fn func() ([]*SignKey, error)) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.loader = fn
+}
+
+//Reload 重新加载密钥,加载失败保留原有密钥
+func (kr *Keyring) Reload() error {
+	kr.mu.RLock()
+	fn := kr.loader
+	kr.mu.RUnlock()
+	if fn == nil {
+		return errors.New("keyring loader not set")
+	}
+	keys, err := fn()
+	if err != nil {
+		return err
+	}
+	kr.Set(keys...)
+	return nil
+}
+
+//ReloadEvery 定时重新加载密钥,返回停止函数
+func (kr *Keyring) ReloadEvery(d time.Duration, onerr ...func(error)) func() {
+	done := make(chan bool)
+	go func() {
+		tk := time.NewTicker(d)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				if err := kr.Reload(); err != nil && len(onerr) > 0 {
+					onerr[0](err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+//多密钥签名器,通过NF-Key-Id选择密钥
+type keyringsigner struct {
+	kr     *Keyring
+	buf    *bytes.Buffer
+	replay SignReplay
+}
+
+//签名内容 host+post+path+nonce+ts+sha256(body)
+func (ks *keyringsigner) getData(body []byte, ts string, nonce string, ads ...string) ([]byte, error) {
+	adss := strings.Join(ads, "")
+	if adss == "" {
+		return nil, fmt.Errorf("adss emtpy")
+	}
+	bhash := sha256.Sum256(body)
+	return []byte(adss + nonce + ts + hex.EncodeToString(bhash[:])), nil
+}
+
+func (ks *keyringsigner) create(key *SignKey, ads ...string) (string, string, string, error) {
+	nonce := RandStr()
+	ts := fmt.Sprintf("%d", time.Now().Unix())
+	data, err := ks.getData(ks.buf.Bytes(), ts, nonce, ads...)
+	if err != nil {
+		return "", "", "", err
+	}
+	sign, err := key.Sign(data)
+	if err != nil {
+		return "", "", "", err
+	}
+	return sign, ts, nonce, nil
+}
+
+func (ks *keyringsigner) verify(key *SignKey, data []byte, sign string, ts string, nonce string, ads ...string) error {
+	if sign == "" || ts == "" || nonce == "" {
+		return ErrSignEmpty
+	}
+	if key.State == KeyRetired {
+		return ErrSignKey
+	}
+	ttl, err := ks.replay.checkTimestamp(ts)
+	if err != nil {
+		return err
+	}
+	sd, err := ks.getData(data, ts, nonce, ads...)
+	if err != nil {
+		return err
+	}
+	if err := key.Verify(sd, sign); err != nil {
+		return err
+	}
+	return ks.replay.checkNonce(nonce, ttl)
+}
+
+//Create 使用当前签名密钥签名,密钥id需要通过SignHeader输出
+func (ks *keyringsigner) Create(ads ...string) (string, string, string, error) {
+	key, err := ks.kr.Active()
+	if err != nil {
+		return "", "", "", err
+	}
+	return ks.create(key, ads...)
+}
+
+//Verify 没有密钥id时使用当前签名密钥验证
+func (ks *keyringsigner) Verify(data []byte, sign string, ts string, nonce string, ads ...string) error {
+	key, err := ks.kr.Active()
+	if err != nil {
+		return err
+	}
+	return ks.verify(key, data, sign, ts, nonce, ads...)
+}
+
+func (ks *keyringsigner) VerifyHeader(h http.Header, data []byte, req *http.Request, status int) error {
+	id := h.Get(NF_KeyId)
+	if id == "" {
+		return ks.Verify(data, h.Get(NF_Signature), h.Get(NF_Timestamp), h.Get(NF_Nonce), signAds(req, status)...)
+	}
+	key, ok := ks.kr.Get(id)
+	if !ok {
+		return ErrSignKey
+	}
+	return ks.verify(key, data, h.Get(NF_Signature), h.Get(NF_Timestamp), h.Get(NF_Nonce), signAds(req, status)...)
+}
+
+func (ks *keyringsigner) SignHeader(h http.Header, req *http.Request, status int) error {
+	key, err := ks.kr.Active()
+	if err != nil {
+		return err
+	}
+	sign, ts, nonce, err := ks.create(key, signAds(req, status)...)
+	if err != nil {
+		return err
+	}
+	h.Set(NF_KeyId, key.ID)
+	h.Set(NF_Nonce, nonce)
+	h.Set(NF_Signature, sign)
+	h.Set(NF_Timestamp, ts)
+	return nil
+}
+
+func (ks *keyringsigner) New() ISigner {
+	return &keyringsigner{kr: ks.kr, buf: &bytes.Buffer{}, replay: ks.replay}
+}
+
+func (ks *keyringsigner) Write(data []byte) error {
+	_, err := ks.buf.Write(data)
+	return err
+}
+
+//NewKeyringSigner 创建多密钥签名器,请求通过NF-Key-Id选择验证密钥
+//响应使用第一个KeyActive状态的密钥签名
+func NewKeyringSigner(kr *Keyring, replay ...SignReplay) ISigner {
+	ks := &keyringsigner{kr: kr, buf: &bytes.Buffer{}}
+	if len(replay) > 0 {
+		ks.replay = replay[0]
+	}
+	return ks
+}
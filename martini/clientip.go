@@ -0,0 +1,189 @@
+package martini
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IPResolver resolves the client address of a request. Forwarding headers are
+// only honoured when the connecting peer is a trusted proxy, and the forwarding
+// chain is walked from the right so that a client cannot spoof its address by
+// sending its own X-Forwarded-For or Forwarded header.
+type IPResolver struct {
+	mu      sync.RWMutex
+	proxies []*net.IPNet
+}
+
+// DefaultIPResolver is used by ClientIP and Logger. It trusts loopback proxies only.
+var DefaultIPResolver = MustIPResolver("127.0.0.0/8", "::1/128")
+
+// NewIPResolver creates a resolver trusting the given proxy CIDRs or single addresses.
+func NewIPResolver(cidrs ...string) (*IPResolver, error) {
+	r := &IPResolver{}
+	if err := r.SetTrustedProxies(cidrs...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// MustIPResolver is like NewIPResolver but panics on an invalid CIDR.
+func MustIPResolver(cidrs ...string) *IPResolver {
+	r, err := NewIPResolver(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// SetTrustedProxies replaces the trusted proxy list. Single addresses are accepted as /32 or /128.
+func (r *IPResolver) SetTrustedProxies(cidrs ...string) error {
+	proxies := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		proxies = append(proxies, n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.proxies = proxies
+	return nil
+}
+
+// Trusted reports whether ip belongs to a trusted proxy.
+func (r *IPResolver) Trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, n := range r.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedPeer reports whether the connecting peer of req is a trusted proxy.
+func (r *IPResolver) TrustedPeer(req *http.Request) bool {
+	return r.Trusted(net.ParseIP(normalizeIP(req.RemoteAddr)))
+}
+
+// ClientIP returns the client address of req without port or brackets.
+// The Forwarded header (RFC 7239) takes precedence over X-Forwarded-For,
+// X-Real-IP is used only when neither is present. Entries that are not IP
+// addresses, such as "unknown" or obfuscated identifiers like "_hidden", do
+// not identify the client, so the nearest trusted hop is returned instead.
+func (r *IPResolver) ClientIP(req *http.Request) string {
+	peer := normalizeIP(req.RemoteAddr)
+	if !r.Trusted(net.ParseIP(peer)) {
+		return peer
+	}
+	chain := forwardedFor(req.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = forwardedList(req.Header.Values("X-Forwarded-For"))
+	}
+	if len(chain) == 0 {
+		if x := normalizeIP(req.Header.Get("X-Real-IP")); net.ParseIP(x) != nil {
+			return x
+		}
+		return peer
+	}
+	hop := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr := normalizeIP(chain[i])
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			// unknown or obfuscated, the last trusted hop is all we know
+			return hop
+		}
+		if !r.Trusted(ip) {
+			// the hop right of this one is trusted, so this entry is what it saw
+			return addr
+		}
+		hop = addr
+	}
+	return hop
+}
+
+// ClientIP resolves the client address using DefaultIPResolver.
+func ClientIP(req *http.Request) string {
+	return DefaultIPResolver.ClientIP(req)
+}
+
+// normalizeIP strips quotes, brackets, ports and zones, and returns the
+// canonical form of valid addresses or the trimmed value otherwise.
+func normalizeIP(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.LastIndex(s, "%"); i > 0 {
+		s = s[:i]
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// forwardedList splits X-Forwarded-For values in order.
+func forwardedList(values []string) []string {
+	ret := []string{}
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded values in order.
+func forwardedFor(values []string) []string {
+	ret := []string{}
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			for _, pair := range splitQuoted(elem, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "for") {
+					ret = append(ret, strings.TrimSpace(kv[1]))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// splitQuoted splits s on sep outside of double quotes.
+func splitQuoted(s string, sep byte) []string {
+	ret := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, s[start:])
+}
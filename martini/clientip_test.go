@@ -0,0 +1,44 @@
+package martini
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_ClientIP(t *testing.T) {
+	r := MustIPResolver("10.0.0.0/8", "2001:db8::/32", "127.0.0.1")
+	tests := []struct {
+		remote string
+		header map[string]string
+		want   string
+	}{
+		// untrusted peer, headers ignored
+		{"203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		{"[2001:db9::1]:443", map[string]string{"X-Real-IP": "1.1.1.1"}, "2001:db9::1"},
+		// walk from the right, skipping trusted proxies
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"127.0.0.1:80", map[string]string{"X-Forwarded-For": "10.1.1.1, 10.0.0.2"}, "10.1.1.1"},
+		{"[2001:db8::2]:80", map[string]string{"X-Forwarded-For": "2001:DB9::17"}, "2001:db9::17"},
+		// RFC 7239
+		{"10.0.0.1:80", map[string]string{
+			"Forwarded":       `for=6.6.6.6, for="[2001:db9:cafe::17]:4711";proto=https, for=10.0.0.3;by=10.0.0.1`,
+			"X-Forwarded-For": "5.5.5.5",
+		}, "2001:db9:cafe::17"},
+		// unknown or obfuscated identifiers fall back to the nearest trusted hop
+		{"10.0.0.1:80", map[string]string{"Forwarded": `for=unknown`}, "10.0.0.1"},
+		{"10.0.0.1:80", map[string]string{"Forwarded": `for=_hidden, for=10.0.0.3`}, "10.0.0.3"},
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "6.6.6.6, unknown"}, "10.0.0.1"},
+		{"10.0.0.1:80", map[string]string{"X-Real-IP": "_hidden"}, "10.0.0.1"},
+		{"10.0.0.1:80", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"10.0.0.1:80", nil, "10.0.0.1"},
+	}
+	for _, v := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = v.remote
+		for k, h := range v.header {
+			req.Header.Set(k, h)
+		}
+		expect(t, r.ClientIP(req), v.want)
+	}
+	refute(t, r.SetTrustedProxies("10.0.0.0/33"), nil)
+}
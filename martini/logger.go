@@ -11,13 +11,7 @@ import (
 func Logger() Handler {
 	return func(res http.ResponseWriter, req *http.Request, c Context, log *logging.Logger) {
 		start := time.Now()
-		addr := req.Header.Get("X-Real-IP")
-		if addr == "" {
-			addr = req.Header.Get("X-Forwarded-For")
-			if addr == "" {
-				addr = req.RemoteAddr
-			}
-		}
+		addr := ClientIP(req)
 		rw := res.(ResponseWriter)
 		c.Next()
 		if Env != Dev {
@@ -0,0 +1,436 @@
+package xweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cxuhua/xweb/logging"
+	"github.com/cxuhua/xweb/martini"
+)
+
+//限流算法
+const (
+	LimitTokenBucket   = iota //令牌桶,允许Burst突发
+	LimitSlidingWindow        //滑动窗口,按上一窗口计数加权估算
+)
+
+//限流相关头
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+var (
+	//ErrRateLimited 请求过于频繁
+	ErrRateLimited = errors.New("too many requests")
+	//UseLimiter 全局限流器,分发器没有实现ILimiterDispatcher时使用
+	//默认使用进程内存储,集群使用NewCacheLimitStore
+	UseLimiter = NewLimiter(NewMemoryLimitStore())
+)
+
+//RateLimit 限流速率,Period时间内允许Limit次请求
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+	//令牌桶容量,为0使用Limit
+	Burst int
+}
+
+func (r RateLimit) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Limit
+}
+
+//String 输出 100/1m0s 格式
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%d/%v", r.Limit, r.Period)
+}
+
+//ParseRateLimit 解析速率 100/m 10/30s 1000/h 5/d
+func ParseRateLimit(s string) (RateLimit, error) {
+	r := RateLimit{}
+	ps := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(ps) != 2 {
+		return r, fmt.Errorf("rate limit %s format error", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(ps[0]))
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("rate limit %s count error", s)
+	}
+	r.Limit = n
+	switch u := strings.TrimSpace(ps[1]); u {
+	case "s":
+		r.Period = time.Second
+	case "m":
+		r.Period = time.Minute
+	case "h":
+		r.Period = time.Hour
+	case "d":
+		r.Period = time.Hour * 24
+	default:
+		d, err := time.ParseDuration(u)
+		if err != nil || d <= 0 {
+			return r, fmt.Errorf("rate limit %s period error", s)
+		}
+		r.Period = d
+	}
+	return r, nil
+}
+
+//LimitResult 限流结果
+type LimitResult struct {
+	//是否允许
+	Allowed bool
+	//限制次数
+	Limit int
+	//剩余次数
+	Remaining int
+	//恢复到满额的时间
+	Reset time.Duration
+	//拒绝时需要等待的时间
+	RetryAfter time.Duration
+}
+
+//限流状态,可以序列化保存到ICache
+//令牌桶 A:剩余令牌 T:上次填充时间
+//滑动窗口 A:上一窗口计数 B:当前窗口计数 T:当前窗口开始时间
+type limitState struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+	T int64   `json:"t"`
+}
+
+//令牌桶
+func (st *limitState) tokenBucket(rate RateLimit, now time.Time) *LimitResult {
+	capacity := float64(rate.burst())
+	//每纳秒生成的令牌
+	speed := float64(rate.Limit) / float64(rate.Period)
+	ts := now.UnixNano()
+	if st.T == 0 {
+		st.A = capacity
+	} else if ts > st.T {
+		st.A = math.Min(capacity, st.A+float64(ts-st.T)*speed)
+	}
+	st.T = ts
+	res := &LimitResult{Limit: rate.burst()}
+	if st.A >= 1 {
+		st.A--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - st.A) / speed)
+	}
+	res.Remaining = int(st.A)
+	res.Reset = time.Duration((capacity - st.A) / speed)
+	return res
+}
+
+//滑动窗口
+func (st *limitState) slidingWindow(rate RateLimit, now time.Time) *LimitResult {
+	period := int64(rate.Period)
+	ts := now.UnixNano()
+	start := ts - ts%period
+	if st.T != start {
+		if st.T == start-period {
+			st.A = st.B
+		} else {
+			st.A = 0
+		}
+		st.B = 0
+		st.T = start
+	}
+	elapsed := ts - start
+	limit := float64(rate.Limit)
+	weight := 1 - float64(elapsed)/float64(period)
+	count := st.A*weight + st.B
+	res := &LimitResult{Limit: rate.Limit, Reset: time.Duration(period - elapsed)}
+	if count+1 <= limit {
+		st.B++
+		res.Allowed = true
+		res.Remaining = int(limit - math.Ceil(count+1))
+		if res.Remaining < 0 {
+			res.Remaining = 0
+		}
+		return res
+	}
+	if st.B+1 > limit || st.A == 0 {
+		//当前窗口已满,等待下一窗口
+		res.RetryAfter = res.Reset
+	} else {
+		//上一窗口权重下降到可以容纳一次请求
+		w := (limit - 1 - st.B) / st.A
+		res.RetryAfter = time.Duration((1-w)*float64(period)) - time.Duration(elapsed)
+	}
+	return res
+}
+
+//take 使用算法更新状态
+func (st *limitState) take(alg int, rate RateLimit, now time.Time) *LimitResult {
+	if alg == LimitSlidingWindow {
+		return st.slidingWindow(rate, now)
+	}
+	return st.tokenBucket(rate, now)
+}
+
+//ILimitStore 限流计数存储,实现需要并发安全
+type ILimitStore interface {
+	//Take 对key消耗一次请求
+	Take(key string, alg int, rate RateLimit) (*LimitResult, error)
+}
+
+//内存存储的状态
+type memoryLimitState struct {
+	limitState
+	exp time.Time
+}
+
+//MemoryLimitStore 进程内限流存储,用于单节点
+type MemoryLimitStore struct {
+	mu     sync.Mutex
+	states map[string]*memoryLimitState
+	//下次清理过期状态的时间
+	sweep time.Time
+}
+
+//NewMemoryLimitStore 创建进程内限流存储
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{states: map[string]*memoryLimitState{}}
+}
+
+//Take 实现ILimitStore
+func (s *MemoryLimitStore) Take(key string, alg int, rate RateLimit) (*LimitResult, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.sweep) {
+		for k, v := range s.states {
+			if now.After(v.exp) {
+				delete(s.states, k)
+			}
+		}
+		s.sweep = now.Add(time.Minute)
+	}
+	st, ok := s.states[key]
+	if !ok {
+		st = &memoryLimitState{}
+		s.states[key] = st
+	}
+	res := st.take(alg, rate, now)
+	st.exp = now.Add(rate.Period * 2)
+	return res, nil
+}
+
+//CacheLimitStore 使用ICache保存限流状态,用于集群
+//通过ICache.Locker保证同一个key的更新互斥,锁使用独立的key,释放锁不会删除状态
+type CacheLimitStore struct {
+	Imp ICache
+	//获取锁的尝试次数和间隔(毫秒),与PTP参数相同
+	Try []int
+}
+
+//NewCacheLimitStore 创建缓存限流存储
+func NewCacheLimitStore(imp ICache, try ...int) *CacheLimitStore {
+	if len(try) == 0 {
+		try = []int{10, 5}
+	}
+	return &CacheLimitStore{Imp: imp, Try: try}
+}
+
+//Take 实现ILimitStore
+func (s *CacheLimitStore) Take(key string, alg int, rate RateLimit) (*LimitResult, error) {
+	lk := "_lck_" + key
+	lck, err := s.Imp.Locker(lk, time.Second)
+	for tc, tv := PTP(s.Try...); err != nil && tc > 0; tc-- {
+		time.Sleep(tv)
+		lck, err = s.Imp.Locker(lk, time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lck.Release()
+	st := &limitState{}
+	var bb []byte
+	if err := s.Imp.Get(key, &bb); err == nil {
+		if err := json.Unmarshal(bb, st); err != nil {
+			st = &limitState{}
+		}
+	}
+	res := st.take(alg, rate, time.Now())
+	bb, err = json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Imp.Set(key, bb, rate.Period*2); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//LimitKeyFunc 获取限流key,返回空使用下一个
+type LimitKeyFunc func(c martini.Context, req *http.Request) string
+
+//LimitByIP 按客户端ip限流
+func LimitByIP() LimitKeyFunc {
+	return func(c martini.Context, req *http.Request) string {
+		return "ip:" + GetRemoteAddr(req)
+	}
+}
+
+//LimitByPrincipal 按认证用户限流,需要在auth之后,没有用户返回空
+func LimitByPrincipal() LimitKeyFunc {
+	pt := reflect.TypeOf((*Principal)(nil))
+	return func(c martini.Context, req *http.Request) string {
+		pv := c.Get(pt)
+		if !pv.IsValid() || pv.IsNil() {
+			return ""
+		}
+		return "user:" + pv.Interface().(*Principal).ID
+	}
+}
+
+//LimitByHeader 按http头限流,例如api key
+func LimitByHeader(name string) LimitKeyFunc {
+	return func(c martini.Context, req *http.Request) string {
+		if v := req.Header.Get(name); v != "" {
+			return "header:" + v
+		}
+		return ""
+	}
+}
+
+//Limiter 限流器
+type Limiter struct {
+	//计数存储
+	Store ILimitStore
+	//限流算法,默认LimitTokenBucket
+	Algorithm int
+	//依次获取限流key,默认先按用户后按ip
+	Keys []LimitKeyFunc
+	//存储key前缀,默认_rl_
+	Prefix string
+}
+
+//NewLimiter 创建限流器
+func NewLimiter(store ILimitStore, keys ...LimitKeyFunc) *Limiter {
+	if len(keys) == 0 {
+		keys = []LimitKeyFunc{LimitByPrincipal(), LimitByIP()}
+	}
+	return &Limiter{Store: store, Keys: keys, Prefix: "_rl_"}
+}
+
+//获取请求的限流key
+func (l *Limiter) key(c martini.Context, req *http.Request) string {
+	for _, fn := range l.Keys {
+		if k := fn(c, req); k != "" {
+			return k
+		}
+	}
+	return ""
+}
+
+//Take 消耗一次请求,scope区分不同的限流范围,例如路由
+//存储错误时允许请求并返回错误
+func (l *Limiter) Take(c martini.Context, req *http.Request, scope string, rate RateLimit) (*LimitResult, error) {
+	key := l.key(c, req)
+	if key == "" {
+		return &LimitResult{Allowed: true, Limit: rate.Limit, Remaining: rate.Limit}, nil
+	}
+	res, err := l.Store.Take(l.Prefix+scope+"|"+key, l.Algorithm, rate)
+	if err != nil {
+		return &LimitResult{Allowed: true, Limit: rate.Limit, Remaining: rate.Limit}, err
+	}
+	return res, nil
+}
+
+//向上取整的秒数
+func limitSeconds(d time.Duration) string {
+	s := int64(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10)
+}
+
+//SetHeaders 输出RateLimit-*头,拒绝时输出Retry-After
+func (res *LimitResult) SetHeaders(h http.Header, rate RateLimit) {
+	h.Set(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+	h.Set(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+	h.Set(HeaderRateLimitReset, limitSeconds(res.Reset))
+	h.Set(HeaderRateLimitPolicy, fmt.Sprintf("%d;w=%s", rate.Limit, limitSeconds(rate.Period)))
+	if !res.Allowed {
+		h.Set(HeaderRetryAfter, limitSeconds(res.RetryAfter))
+	}
+}
+
+//Handler 全局限流,用于HttpContext.Use或Group,所有请求共享同一个范围
+//	ctx.Use(xweb.UseLimiter.Handler("1000/m"))
+func (l *Limiter) Handler(rate string) martini.Handler {
+	r, err := ParseRateLimit(rate)
+	if err != nil {
+		panic(err)
+	}
+	return func(c martini.Context, rw http.ResponseWriter, req *http.Request, log *logging.Logger) {
+		res, err := l.Take(c, req, "*", r)
+		if err != nil {
+			log.Error("rate limit error:", err)
+		}
+		res.SetHeaders(rw.Header(), r)
+		if !res.Allowed {
+			http.Error(rw, ErrRateLimited.Error(), http.StatusTooManyRequests)
+		}
+	}
+}
+
+//ILimiterDispatcher 分发器实现此接口使用独立的限流器,返回nil使用UseLimiter
+type ILimiterDispatcher interface {
+	Limiter() *Limiter
+}
+
+//获取分发器使用的限流器
+func (ctx *HttpContext) dispatcherLimiter(c IDispatcher) *Limiter {
+	if ld, ok := c.(ILimiterDispatcher); ok {
+		if l := ld.Limiter(); l != nil {
+			return l
+		}
+	}
+	return UseLimiter
+}
+
+//limit tag限流处理,scope不为空时按分组路径区分范围,否则按路由区分
+func (ctx *HttpContext) limitHandler(rate string, scope string, c IDispatcher, iv IArgs) martini.Handler {
+	r, err := ParseRateLimit(rate)
+	if err != nil {
+		panic(err)
+	}
+	return func(mc martini.Context, route martini.Route, mvc IMVC, rw http.ResponseWriter, req *http.Request, log *logging.Logger) {
+		l := ctx.dispatcherLimiter(c)
+		if l == nil {
+			return
+		}
+		key := "GROUP " + scope
+		if scope == "" {
+			key = route.Method() + " " + route.Pattern()
+		}
+		res, err := l.Take(mc, req, key, r)
+		if err != nil {
+			log.Error("rate limit error:", err)
+		}
+		res.SetHeaders(rw.Header(), r)
+		if !res.Allowed {
+			ctx.abort(mvc, iv, http.StatusTooManyRequests, ErrRateLimited)
+			mvc.SkipAll()
+		}
+	}
+}
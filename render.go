@@ -2,6 +2,8 @@ package xweb
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -37,6 +39,17 @@ const (
 	defaultCharset    = "UTF-8"
 )
 
+//http缓存相关头
+const (
+	HeaderETag            = "ETag"
+	HeaderLastModified    = "Last-Modified"
+	HeaderCacheControl    = "Cache-Control"
+	HeaderVary            = "Vary"
+	HeaderIfNoneMatch     = "If-None-Match"
+	HeaderIfModifiedSince = "If-Modified-Since"
+	HeaderContentEncoding = "Content-Encoding"
+)
+
 // Provides a temporary buffer to execute templates into and catch errors.
 var bufpool *bpool.BufferPool
 
@@ -81,6 +94,8 @@ type Render interface {
 	SetCookie(cookie *http.Cookie)
 	// cache config
 	CacheParams(v *CacheParams)
+	// Signer sets the per request signer used to sign the response.
+	Signer(v ISigner)
 }
 
 // Delims represents a set of Left and Right delimiters for HTML template rendering
@@ -115,6 +130,10 @@ type RenderOptions struct {
 	PrefixXML []byte
 	// Allows changing of output to XHTML instead of HTML. Default is "text/html"
 	HTMLContentType string
+	// Request headers the response depends on (content negotiation), added to the Vary header. Defaults to [].
+	Vary []string
+	// Disables ETag generation and conditional GET (304) handling.
+	DisableETag bool
 }
 
 // HTMLOptions is a struct for overriding some rendering Options for specific HTML call
@@ -157,6 +176,7 @@ func Renderer(options ...RenderOptions) martini.Handler {
 			}
 			return vv.Interface(), nil
 		}
+		rd := &renderer{res, req, tc, opt, cs, nil, log, nil, false}
 		tc.Funcs(template.FuncMap{
 			"import": func(name string, kv ...string) (template.HTML, error) {
 				vv, err := getValueFunc(name)
@@ -174,8 +194,32 @@ func Renderer(options ...RenderOptions) martini.Handler {
 				}
 				return vv
 			},
+			"csrfToken": func() (string, error) {
+				st, err := csrfStateFunc(c)
+				if err != nil {
+					return "", err
+				}
+				return st.Token(), nil
+			},
+			"csrfField": func() (template.HTML, error) {
+				st, err := csrfStateFunc(c)
+				if err != nil {
+					return "", err
+				}
+				return st.Field(), nil
+			},
+			"cspNonce": func() (string, error) {
+				rd.nonce = true
+				return cspNonceFunc(c)
+			},
+			"session": func(key string) interface{} {
+				return sessionValueFunc(c, key)
+			},
+			"flashes": func(vars ...string) []interface{} {
+				return sessionFlashesFunc(c, vars...)
+			},
 		})
-		c.MapTo(&renderer{res, req, tc, opt, cs, nil, log}, (*Render)(nil))
+		c.MapTo(rd, (*Render)(nil))
 	}
 }
 
@@ -230,8 +274,13 @@ func compile(options RenderOptions) *template.Template {
 				tmpl := t.New(filepath.ToSlash(name))
 				//for skip error
 				tmpl.Funcs(template.FuncMap{
-					"import": func() interface{} { return nil },
-					"value":  func() interface{} { return nil },
+					"import":    func() interface{} { return nil },
+					"value":     func() interface{} { return nil },
+					"csrfToken": func() interface{} { return nil },
+					"csrfField": func() interface{} { return nil },
+					"cspNonce":  func() interface{} { return nil },
+					"session":   func() interface{} { return nil },
+					"flashes":   func() interface{} { return nil },
 				})
 				// add our funcmaps
 				for _, funcs := range options.Funcs {
@@ -262,12 +311,19 @@ type renderer struct {
 	compiledCharset string
 	cpv             *CacheParams
 	log             *logging.Logger
+	signer          ISigner
+	//模版使用了cspNonce,输出内容每个请求不同
+	nonce bool
 }
 
 func (this *renderer) CacheParams(v *CacheParams) {
 	this.cpv = v
 }
 
+func (this *renderer) Signer(v ISigner) {
+	this.signer = v
+}
+
 func (r *renderer) SetCookie(cookie *http.Cookie) {
 	http.SetCookie(r.ResponseWriter, cookie)
 }
@@ -290,39 +346,11 @@ func (r *renderer) JSON(status int, v interface{}) {
 	}
 	// json rendered fine, write out the result
 	r.Header().Set(ContentType, ContentJSON+r.compiledCharset)
-	r.WriteHeader(status)
-	if len(r.opt.PrefixJSON) > 0 {
-		if UseSigner != nil {
-			err = UseSigner.Write(r.opt.PrefixJSON)
-			if err != nil {
-				http.Error(r, err.Error(), 500)
-				return
-			}
-		}
-		_, _ = r.Write(r.opt.PrefixJSON)
-	}
-	if r.cpv != nil {
-		_ = r.cpv.SetBytes(result)
-	}
+	r.setCache(status, r.opt.PrefixJSON, result)
 	if martini.Env == martini.Dev && r.log != nil {
 		r.log.Println("Send JSON:", string(result))
 	}
-	if UseSigner != nil {
-		err = UseSigner.Write(result)
-		if err != nil {
-			http.Error(r, err.Error(), 500)
-			return
-		}
-		sign, ts, nonce, err := UseSigner.Create(r.req.Host, r.req.Method, r.req.URL.Path)
-		if err != nil {
-			http.Error(r, err.Error(), 500)
-			return
-		}
-		r.Header().Set(NF_Nonce, nonce)
-		r.Header().Set(NF_Signature, sign)
-		r.Header().Set(NF_Timestamp, ts)
-	}
-	_, _ = r.Write(result)
+	r.send(status, r.opt.PrefixJSON, result)
 }
 
 func (r *renderer) TEMP(status int, template string, data interface{}) {
@@ -337,6 +365,9 @@ func (r *renderer) TEMP(status int, template string, data interface{}) {
 		return
 	}
 	r.Header().Set(ContentType, r.opt.HTMLContentType+r.compiledCharset)
+	if !r.sign(status, buf.Bytes()) {
+		return
+	}
 	r.WriteHeader(status)
 	_, _ = io.Copy(r, buf)
 	bufpool.Put(buf)
@@ -354,14 +385,11 @@ func (r *renderer) HTML(status int, name string, binding interface{}, htmlOpt ..
 		http.Error(r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer bufpool.Put(buf)
 	// template rendered fine, write out the result
 	r.Header().Set(ContentType, r.opt.HTMLContentType+r.compiledCharset)
-	r.WriteHeader(status)
-	if r.cpv != nil {
-		_ = r.cpv.SetBytes(buf.Bytes())
-	}
-	_, _ = io.Copy(r, buf)
-	bufpool.Put(buf)
+	r.setCache(status, buf.Bytes())
+	r.send(status, buf.Bytes())
 }
 
 func (r *renderer) XML(status int, v interface{}) {
@@ -378,39 +406,157 @@ func (r *renderer) XML(status int, v interface{}) {
 	}
 	// XML rendered fine, write out the result
 	r.Header().Set(ContentType, ContentXML+r.compiledCharset)
-	r.WriteHeader(status)
-	if len(r.opt.PrefixXML) > 0 {
-		_, _ = r.Write(r.opt.PrefixXML)
-	}
-	if r.cpv != nil {
-		_ = r.cpv.SetBytes(result)
-	}
+	r.setCache(status, r.opt.PrefixXML, result)
 	if martini.Env == martini.Dev && r.log != nil {
 		r.log.Println("Send XML:", string(result))
 	}
-	_, _ = r.Write(result)
+	r.send(status, r.opt.PrefixXML, result)
 }
 
 func (r *renderer) Data(status int, v []byte) {
 	if r.Header().Get(ContentType) == "" {
 		r.Header().Set(ContentType, ContentBinary)
 	}
-	r.WriteHeader(status)
-	if r.cpv != nil {
-		_ = r.cpv.SetBytes(v)
-	}
-	_, _ = r.Write(v)
+	r.setCache(status, v)
+	r.send(status, v)
 }
 
 func (r *renderer) Text(status int, v string) {
 	if r.Header().Get(ContentType) == "" {
 		r.Header().Set(ContentType, ContentText+r.compiledCharset)
 	}
+	b := []byte(v)
+	r.setCache(status, b)
+	r.send(status, b)
+}
+
+//输出响应,先判断是否返回304,再使用最终的状态和输出的内容签名
+func (r *renderer) send(status int, body ...[]byte) {
+	if r.notModified(status, body...) {
+		status, body = http.StatusNotModified, nil
+	}
+	if !r.sign(status, body...) {
+		return
+	}
 	r.WriteHeader(status)
-	if r.cpv != nil {
-		_ = r.cpv.SetBytes([]byte(v))
+	for _, b := range body {
+		if len(b) > 0 {
+			_, _ = r.Write(b)
+		}
+	}
+}
+
+//签名响应内容,签名信息写入响应头,签名失败输出500并返回false
+//签名需要在setCache之后,签名头不保存到缓存,缓存命中时重新签名
+//304响应使用304状态和空内容签名
+func (r *renderer) sign(status int, body ...[]byte) bool {
+	if r.signer == nil {
+		return true
+	}
+	for _, b := range body {
+		if len(b) == 0 {
+			continue
+		}
+		if err := r.signer.Write(b); err != nil {
+			http.Error(r, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+	if err := SignWithSigner(r.signer, r.Header(), r.req, status); err != nil {
+		http.Error(r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+//保存状态,响应头和内容到缓存,不允许缓存的状态不保存
+//模版使用了cspNonce时不缓存,缓存命中时内容中的nonce与新的CSP头不一致
+func (r *renderer) setCache(status int, body ...[]byte) {
+	if r.cpv == nil || !r.cpv.IsCacheable(status) || r.nonce {
+		return
+	}
+	e := NewCacheEntry(status, r.cpv.FilterHeader(r.Header()), body...)
+	if err := r.cpv.SetEntry(e); err != nil && r.log != nil {
+		r.log.Error("set cache error", err)
+	}
+}
+
+//ContentETag 根据内容hash生成强校验ETag
+func ContentETag(body ...[]byte) string {
+	h := sha256.New()
+	for _, b := range body {
+		_, _ = h.Write(b)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+//是否匹配If-None-Match中的ETag,使用弱比较
+func etagMatch(inm string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(inm, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//addVary 添加Vary头,已经存在的不重复添加
+func addVary(h http.Header, vs ...string) {
+	for _, v := range vs {
+		exists := false
+		for _, hv := range h.Values(HeaderVary) {
+			for _, iv := range strings.Split(hv, ",") {
+				if strings.EqualFold(strings.TrimSpace(iv), v) {
+					exists = true
+				}
+			}
+		}
+		if !exists {
+			h.Add(HeaderVary, v)
+		}
+	}
+}
+
+//设置ETag,Cache-Control,Vary等缓存头
+//如果是条件GET并且客户端缓存有效返回true,由调用者输出304
+func (r *renderer) notModified(status int, body ...[]byte) bool {
+	h := r.Header()
+	if r.cpv != nil && r.cpv.IsCacheable(status) {
+		h.Set(HeaderCacheControl, r.cpv.CacheControl())
+		h.Set(HeaderLastModified, time.Now().UTC().Format(http.TimeFormat))
+	}
+	if len(r.opt.Vary) > 0 {
+		addVary(h, r.opt.Vary...)
+	}
+	if h.Get(HeaderContentEncoding) != "" {
+		addVary(h, "Accept-Encoding")
+	}
+	//包含nonce的内容每次不同,ETag不会匹配
+	if r.opt.DisableETag || r.nonce || status != http.StatusOK {
+		return false
+	}
+	etag := ContentETag(body...)
+	h.Set(HeaderETag, etag)
+	if r.req.Method != http.MethodGet && r.req.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.req.Header.Get(HeaderIfNoneMatch); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.req.Header.Get(HeaderIfModifiedSince)); err == nil {
+		lm, err := http.ParseTime(h.Get(HeaderLastModified))
+		if err != nil || lm.Truncate(time.Second).After(ims) {
+			return false
+		}
+	} else {
+		return false
 	}
-	_, _ = r.Write([]byte(v))
+	h.Del(ContentType)
+	h.Del(ContentLength)
+	return true
 }
 
 // Error writes the given HTTP status to the current ResponseWriter
@@ -0,0 +1,183 @@
+package xweb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+//安全相关头
+const (
+	HeaderHSTS                    = "Strict-Transport-Security"
+	HeaderContentTypeOptions      = "X-Content-Type-Options"
+	HeaderFrameOptions            = "X-Frame-Options"
+	HeaderReferrerPolicy          = "Referrer-Policy"
+	HeaderPermissionsPolicy       = "Permissions-Policy"
+	HeaderContentSecurityPolicy   = "Content-Security-Policy"
+	HeaderContentSecurityPolicyRO = "Content-Security-Policy-Report-Only"
+	//CSP中替换为当前请求nonce的占位符
+	CSPNoncePlaceholder = "{nonce}"
+)
+
+//SecurityOptions 安全头配置,字段为空不输出对应的头
+type SecurityOptions struct {
+	//HSTS有效期,只在https请求输出
+	HSTSMaxAge time.Duration
+	//HSTS包含子域名
+	HSTSIncludeSubdomains bool
+	//HSTS预加载
+	HSTSPreload bool
+	//输出X-Content-Type-Options: nosniff
+	NoSniff bool
+	//X-Frame-Options DENY或SAMEORIGIN
+	FrameOptions string
+	//Referrer-Policy
+	ReferrerPolicy string
+	//Permissions-Policy 例如 camera=(), geolocation=()
+	PermissionsPolicy string
+	//Content-Security-Policy,{nonce}替换为当前请求的nonce
+	//模版中使用 <script nonce="{{cspNonce}}">
+	//使用了cspNonce的输出每次都不同,不保存到响应缓存,也不输出ETag
+	CSP string
+	//只报告不拦截,输出Content-Security-Policy-Report-Only
+	CSPReportOnly bool
+	//CSP违规报告地址,追加report-uri指令
+	CSPReportURI string
+}
+
+var (
+	//DefaultSecurityOptions 默认安全头配置
+	DefaultSecurityOptions = SecurityOptions{
+		HSTSMaxAge:            time.Hour * 24 * 365,
+		HSTSIncludeSubdomains: true,
+		NoSniff:               true,
+		FrameOptions:          "SAMEORIGIN",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		CSP:                   "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'self'",
+	}
+)
+
+//CSPNonce 当前请求的CSP nonce,由SecurityHandler映射
+type CSPNonce string
+
+//生成nonce
+func newCSPNonce() CSPNonce {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return CSPNonce(base64.RawURLEncoding.EncodeToString(b))
+}
+
+//是否是https请求,来自可信代理时使用X-Forwarded-Proto
+func isHTTPS(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	return martini.DefaultIPResolver.TrustedPeer(req) && strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+//输出CSP头
+func (opt SecurityOptions) setCSP(h http.Header, nonce CSPNonce) {
+	h.Del(HeaderContentSecurityPolicy)
+	h.Del(HeaderContentSecurityPolicyRO)
+	if opt.CSP == "" || opt.CSP == "-" {
+		return
+	}
+	csp := strings.Replace(opt.CSP, CSPNoncePlaceholder, string(nonce), -1)
+	if opt.CSPReportURI != "" {
+		csp = strings.TrimRight(strings.TrimSpace(csp), ";") + "; report-uri " + opt.CSPReportURI
+	}
+	if opt.CSPReportOnly {
+		h.Set(HeaderContentSecurityPolicyRO, csp)
+	} else {
+		h.Set(HeaderContentSecurityPolicy, csp)
+	}
+}
+
+//输出所有安全头
+func (opt SecurityOptions) apply(h http.Header, req *http.Request, nonce CSPNonce) {
+	setOrDel := func(k string, v string) {
+		if v == "" {
+			h.Del(k)
+		} else {
+			h.Set(k, v)
+		}
+	}
+	hsts := ""
+	if opt.HSTSMaxAge > 0 && isHTTPS(req) {
+		hsts = fmt.Sprintf("max-age=%d", int64(opt.HSTSMaxAge/time.Second))
+		if opt.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if opt.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+	setOrDel(HeaderHSTS, hsts)
+	nosniff := ""
+	if opt.NoSniff {
+		nosniff = "nosniff"
+	}
+	setOrDel(HeaderContentTypeOptions, nosniff)
+	setOrDel(HeaderFrameOptions, opt.FrameOptions)
+	setOrDel(HeaderReferrerPolicy, opt.ReferrerPolicy)
+	setOrDel(HeaderPermissionsPolicy, opt.PermissionsPolicy)
+	opt.setCSP(h, nonce)
+}
+
+//获取或创建当前请求的nonce
+func requestCSPNonce(c martini.Context) CSPNonce {
+	nt := reflect.TypeOf(CSPNonce(""))
+	if nv := c.Get(nt); nv.IsValid() {
+		return nv.Interface().(CSPNonce)
+	}
+	nonce := newCSPNonce()
+	c.Map(nonce)
+	return nonce
+}
+
+//模版函数获取nonce
+func cspNonceFunc(c martini.Context) (string, error) {
+	nv := c.Get(reflect.TypeOf(CSPNonce("")))
+	if !nv.IsValid() {
+		return "", errors.New("csp nonce miss, ctx.Use(xweb.SecurityHandler())")
+	}
+	return string(nv.Interface().(CSPNonce)), nil
+}
+
+//SecurityHandler 输出安全头并映射CSPNonce,没有配置使用DefaultSecurityOptions
+//	ctx.Use(xweb.SecurityHandler())
+//覆盖分发器的配置,用于UseDispatcher或Group
+//	ctx.UseDispatcher(&Admin{}, xweb.SecurityHandler(adminOpt))
+func SecurityHandler(opts ...SecurityOptions) martini.Handler {
+	opt := DefaultSecurityOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	return func(c martini.Context, rw http.ResponseWriter, req *http.Request) {
+		c.Map(&opt)
+		opt.apply(rw.Header(), req, requestCSPNonce(c))
+	}
+}
+
+//csp tag覆盖路由的CSP,-不输出CSP,报告模式和报告地址使用当前请求的配置
+func cspHandler(csp string) martini.Handler {
+	ot := reflect.TypeOf((*SecurityOptions)(nil))
+	return func(c martini.Context, rw http.ResponseWriter) {
+		opt := SecurityOptions{}
+		if ov := c.Get(ot); ov.IsValid() {
+			opt = *ov.Interface().(*SecurityOptions)
+		}
+		opt.CSP = csp
+		opt.setCSP(rw.Header(), requestCSPNonce(c))
+	}
+}
@@ -0,0 +1,64 @@
+package xweb
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/cxuhua/xweb/martini"
+	"github.com/cxuhua/xweb/sessions"
+)
+
+var (
+	sessionType = reflect.TypeOf((*sessions.Session)(nil)).Elem()
+)
+
+//GetSession 获取sessions.Sessions映射的会话,没有使用返回nil
+func GetSession(c martini.Context) sessions.Session {
+	sv := c.Get(sessionType)
+	if !sv.IsValid() || sv.IsNil() {
+		return nil
+	}
+	return sv.Interface().(sessions.Session)
+}
+
+//session tag绑定会话值,类型不同时转换数字和字符串
+func setSessionValue(sess sessions.Session, name string, sf reflect.Value, tf reflect.StructField) {
+	//忽略JSON,XML等请求数据中的同名字段
+	sf.Set(reflect.Zero(sf.Type()))
+	if sess == nil {
+		return
+	}
+	v := sess.Get(name)
+	if v == nil {
+		return
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Type().AssignableTo(sf.Type()):
+		sf.Set(rv)
+	case sf.Kind() == reflect.String:
+		sf.SetString(fmt.Sprintf("%v", v))
+	case rv.Kind() == reflect.String:
+		_ = setKindValue(sf.Kind(), rv.String(), sf)
+	case rv.Type().ConvertibleTo(sf.Type()) && rv.Kind() != reflect.Slice && rv.Kind() != reflect.Map:
+		sf.Set(rv.Convert(sf.Type()))
+	}
+}
+
+//模版函数,获取会话值
+func sessionValueFunc(c martini.Context, key string) interface{} {
+	sess := GetSession(c)
+	if sess == nil {
+		return nil
+	}
+	return sess.Get(key)
+}
+
+//模版函数,获取并清除闪存消息
+func sessionFlashesFunc(c martini.Context, vars ...string) []interface{} {
+	sess := GetSession(c)
+	if sess == nil {
+		return nil
+	}
+	return sess.Flashes(vars...)
+}
@@ -0,0 +1,132 @@
+package xweb
+
+import (
+	"net/http"
+
+	"github.com/cxuhua/xweb/sessions"
+)
+
+const (
+	//SessionAdminPerm 会话管理需要的权限
+	SessionAdminPerm = "sessions.admin"
+)
+
+//SessionModel 会话管理输出
+type SessionModel struct {
+	HTTPModel
+	User     string                 `json:"user"`
+	Sessions []sessions.SessionInfo `json:"sessions,omitempty"`
+	Revoked  int                    `json:"revoked,omitempty"`
+}
+
+//SessionListArgs 列出用户会话参数
+type SessionListArgs struct {
+	URLArgs
+	User string `url:"user" validate:"nonzero"`
+}
+
+func (this *SessionListArgs) Validate(m *ValidateModel, c IMVC) error {
+	c.SetModel(m)
+	c.SetRender(JSON_RENDER)
+	return nil
+}
+
+func (this *SessionListArgs) Model() IModel {
+	return &SessionModel{}
+}
+
+//SessionRevokeArgs 撤销用户会话参数,handle为空时撤销全部
+type SessionRevokeArgs struct {
+	FORMArgs
+	User   string `form:"user" validate:"nonzero"`
+	Handle string `form:"handle"`
+}
+
+func (this *SessionRevokeArgs) Model() IModel {
+	return &SessionModel{}
+}
+
+//SessionAdminDispatcher 会话管理分发器,列出和撤销用户在各设备上的会话
+//需要sessions.admin权限,认证和授权默认使用UseAuth和UsePolicy
+//	ctx.UseDispatcher(xweb.NewSessionAdmin(store, "/admin"))
+type SessionAdminDispatcher struct {
+	HTTPDispatcher
+	List      SessionListArgs   `url:"/sessions" perm:"sessions.admin"`
+	Revoke    SessionRevokeArgs `url:"/sessions/revoke" method:"POST" perm:"sessions.admin"`
+	RevokeAll SessionRevokeArgs `url:"/sessions/revoke_all" method:"POST" perm:"sessions.admin"`
+	store     sessions.CacheStore
+	prefix    string
+	auth      *Authenticator
+	policy    IPolicy
+}
+
+//NewSessionAdmin 创建会话管理分发器,prefix为地址前缀
+func NewSessionAdmin(store sessions.CacheStore, prefix string) *SessionAdminDispatcher {
+	return &SessionAdminDispatcher{store: store, prefix: prefix}
+}
+
+//SetAuth 设置独立的认证器和授权策略,nil使用全局设置
+func (this *SessionAdminDispatcher) SetAuth(auth *Authenticator, policy IPolicy) *SessionAdminDispatcher {
+	this.auth = auth
+	this.policy = policy
+	return this
+}
+
+func (this *SessionAdminDispatcher) URL() string {
+	return this.prefix
+}
+
+func (this *SessionAdminDispatcher) Authenticator() *Authenticator {
+	return this.auth
+}
+
+func (this *SessionAdminDispatcher) Policy() IPolicy {
+	return this.policy
+}
+
+//会话存储错误输出
+func (this *SessionAdminDispatcher) fail(m *SessionModel, c IMVC, err error) {
+	status := http.StatusInternalServerError
+	if err == sessions.ErrSessionNotFound {
+		status = http.StatusNotFound
+	}
+	m.Code = status
+	m.Error = err.Error()
+	c.SetStatus(status)
+}
+
+//ListHandler 列出用户会话
+func (this *SessionAdminDispatcher) ListHandler(args *SessionListArgs, m *SessionModel, c IMVC) {
+	m.User = args.User
+	list, err := this.store.List(args.User)
+	if err != nil {
+		this.fail(m, c, err)
+		return
+	}
+	m.Sessions = list
+}
+
+//RevokeHandler 撤销用户的一个会话
+func (this *SessionAdminDispatcher) RevokeHandler(args *SessionRevokeArgs, m *SessionModel, c IMVC) {
+	m.User = args.User
+	if args.Handle == "" {
+		this.fail(m, c, sessions.ErrSessionNotFound)
+		return
+	}
+	if err := this.store.Revoke(args.User, args.Handle); err != nil {
+		this.fail(m, c, err)
+		return
+	}
+	m.Revoked = 1
+}
+
+//RevokeAllHandler 撤销用户的全部会话,用于退出所有设备
+func (this *SessionAdminDispatcher) RevokeAllHandler(args *SessionRevokeArgs, m *SessionModel, c IMVC) {
+	m.User = args.User
+	n, err := this.store.RevokeAll(args.User)
+	if err != nil {
+		this.fail(m, c, err)
+		return
+	}
+	m.Revoked = n
+}
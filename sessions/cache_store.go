@@ -0,0 +1,335 @@
+package sessions
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Cache is the subset of xweb.ICache used by CacheStore, any xweb.ICache can be used.
+type Cache interface {
+	// Set stores v under k, expiring after exp when given.
+	Set(k string, v interface{}, exp ...time.Duration) error
+	// Get loads the value stored under k into v.
+	Get(k string, v interface{}) error
+	// Del removes the given keys.
+	Del(k ...string) (int64, error)
+}
+
+// CacheStore is a server-side store keeping session data in a Cache,
+// the cookie only carries the signed session ID.
+type CacheStore interface {
+	// Store is an embedded interface so that CacheStore can be used
+	// as a session store.
+	Store
+	// Options sets the default options for each session stored in this
+	// CacheStore.
+	Options(Options)
+	// Serializer sets the encoding of session values, GobSerializer by default.
+	Serializer(Serializer)
+	// Timeout sets the idle and absolute session lifetime, 0 disables the check.
+	Timeout(idle time.Duration, absolute time.Duration)
+	// Regenerate removes the server-side state under the current ID and
+	// assigns a new ID on the next save, keeping the values.
+	Regenerate(session *sessions.Session) error
+	// Destroy removes the server-side state and expires the cookie on the next save.
+	Destroy(session *sessions.Session) error
+	// Bind associates the session with a user, it is added to the user index
+	// on the next save.
+	Bind(session *sessions.Session, userID string) error
+	// List returns the live sessions of a user.
+	List(userID string) ([]SessionInfo, error)
+	// Revoke removes the session of a user with the given handle.
+	Revoke(userID string, handle string) error
+	// RevokeAll removes all sessions of a user and returns how many were removed.
+	RevokeAll(userID string) (int, error)
+}
+
+// metaKey holds the session metadata in Values, it is never serialized.
+type metaKey struct{}
+
+type sessionMeta struct {
+	Created int64
+	UserID  string
+}
+
+// cacheRecord is the value stored in the Cache.
+type cacheRecord struct {
+	Created  int64  `json:"c"`
+	Accessed int64  `json:"a"`
+	User     string `json:"u,omitempty"`
+	Data     []byte `json:"d"`
+}
+
+// NewCacheStore returns a new CacheStore.
+//
+// keyPairs are used to sign the session ID cookie, see NewCookieStore.
+// Sessions expire after 30 minutes idle and 12 hours in total by default.
+func NewCacheStore(cache Cache, keyPairs ...[]byte) CacheStore {
+	return &cacheStore{
+		cache:  cache,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:     "/",
+			HttpOnly: true,
+		},
+		prefix:     "_sess_",
+		serializer: GobSerializer{},
+		idle:       time.Minute * 30,
+		absolute:   time.Hour * 12,
+	}
+}
+
+type cacheStore struct {
+	cache      Cache
+	codecs     []securecookie.Codec
+	options    *sessions.Options
+	prefix     string
+	serializer Serializer
+	idle       time.Duration
+	absolute   time.Duration
+}
+
+func (s *cacheStore) Options(options Options) {
+	s.options = &sessions.Options{
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   options.MaxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HttpOnly,
+	}
+}
+
+func (s *cacheStore) Serializer(serializer Serializer) {
+	s.serializer = serializer
+}
+
+func (s *cacheStore) Timeout(idle time.Duration, absolute time.Duration) {
+	s.idle = idle
+	s.absolute = absolute
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *cacheStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+// An unknown or expired ID is dropped so that a new one is assigned on save.
+func (s *cacheStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	ok, err := s.load(r, session)
+	if !ok {
+		session.ID = ""
+	}
+	session.IsNew = !ok
+	return session, err
+}
+
+// Save writes the session to the cache and the signed ID to the cookie.
+func (s *cacheStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if err := s.drop(session); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	alive, err := s.save(r, session)
+	if err != nil {
+		return err
+	}
+	if !alive {
+		// the record was dropped, expire the cookie instead of sending a dead ID
+		options := *session.Options
+		options.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &options))
+		return nil
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *cacheStore) Regenerate(session *sessions.Session) error {
+	if err := s.drop(session); err != nil {
+		return err
+	}
+	session.ID = ""
+	return nil
+}
+
+func (s *cacheStore) Destroy(session *sessions.Session) error {
+	if err := s.drop(session); err != nil {
+		return err
+	}
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	session.ID = ""
+	session.Options.MaxAge = -1
+	return nil
+}
+
+func (s *cacheStore) Bind(session *sessions.Session, userID string) error {
+	meta, ok := session.Values[metaKey{}].(*sessionMeta)
+	if !ok {
+		meta = &sessionMeta{Created: time.Now().Unix()}
+		session.Values[metaKey{}] = meta
+	}
+	if meta.UserID != userID {
+		if err := s.unindex(session.ID, meta); err != nil {
+			return err
+		}
+	}
+	meta.UserID = userID
+	return nil
+}
+
+// drop removes the session state and its user index entry.
+func (s *cacheStore) drop(session *sessions.Session) error {
+	meta, _ := session.Values[metaKey{}].(*sessionMeta)
+	if err := s.unindex(session.ID, meta); err != nil {
+		return err
+	}
+	return s.delete(session.ID)
+}
+
+func (s *cacheStore) delete(id string) error {
+	if id == "" {
+		return nil
+	}
+	_, err := s.cache.Del(s.prefix + id)
+	return err
+}
+
+// expired reports whether a record has passed the idle or absolute timeout.
+func (s *cacheStore) expired(rec *cacheRecord, now time.Time) bool {
+	if s.absolute > 0 && now.Sub(time.Unix(rec.Created, 0)) > s.absolute {
+		return true
+	}
+	if s.idle > 0 && now.Sub(time.Unix(rec.Accessed, 0)) > s.idle {
+		return true
+	}
+	return false
+}
+
+// ttl is the cache lifetime of a record, bounded by both timeouts.
+// It is negative when the absolute deadline has already passed.
+func (s *cacheStore) ttl(rec *cacheRecord, now time.Time, maxAge int) time.Duration {
+	ttl := s.idle
+	if ttl <= 0 && maxAge > 0 {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	if s.absolute > 0 {
+		left := time.Unix(rec.Created, 0).Add(s.absolute).Sub(now)
+		if left <= 0 {
+			return -1
+		}
+		if ttl <= 0 || left < ttl {
+			ttl = left
+		}
+	}
+	return ttl
+}
+
+// write stores the record, a negative ttl removes it instead so that an
+// expired session is never written without expiry.
+func (s *cacheStore) write(id string, rec *cacheRecord, ttl time.Duration) error {
+	if ttl < 0 {
+		return s.delete(id)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return s.cache.Set(s.prefix+id, data, ttl)
+	}
+	return s.cache.Set(s.prefix+id, data)
+}
+
+// load reads the session from the cache, returns false if it is missing or expired.
+// The idle deadline is extended when more than a tenth of it has passed.
+func (s *cacheStore) load(r *http.Request, session *sessions.Session) (bool, error) {
+	var data []byte
+	if err := s.cache.Get(s.prefix+session.ID, &data); err != nil || len(data) == 0 {
+		return false, nil
+	}
+	rec := &cacheRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	meta := &sessionMeta{Created: rec.Created, UserID: rec.User}
+	if s.expired(rec, now) {
+		if err := s.unindex(session.ID, meta); err != nil {
+			return false, err
+		}
+		return false, s.delete(session.ID)
+	}
+	if err := s.serializer.Deserialize(rec.Data, session); err != nil {
+		return false, err
+	}
+	session.Values[metaKey{}] = meta
+	if s.idle > 0 && now.Sub(time.Unix(rec.Accessed, 0)) > s.idle/10 {
+		rec.Accessed = now.Unix()
+		if err := s.write(session.ID, rec, s.ttl(rec, now, session.Options.MaxAge)); err != nil {
+			return true, err
+		}
+		if meta.UserID != "" {
+			return true, s.index(r, session.ID, meta, now)
+		}
+	}
+	return true, nil
+}
+
+// save writes the record and updates the user index. It returns false when
+// the session is past its absolute timeout and the record was dropped.
+func (s *cacheStore) save(r *http.Request, session *sessions.Session) (bool, error) {
+	now := time.Now()
+	meta, ok := session.Values[metaKey{}].(*sessionMeta)
+	if !ok {
+		meta = &sessionMeta{Created: now.Unix()}
+		session.Values[metaKey{}] = meta
+	}
+	rec := &cacheRecord{Created: meta.Created, Accessed: now.Unix(), User: meta.UserID}
+	data, err := s.serializer.Serialize(session)
+	if err != nil {
+		return false, err
+	}
+	rec.Data = data
+	ttl := s.ttl(rec, now, session.Options.MaxAge)
+	if ttl < 0 {
+		return false, s.drop(session)
+	}
+	if err := s.write(session.ID, rec, ttl); err != nil {
+		return false, err
+	}
+	if meta.UserID != "" {
+		return true, s.index(r, session.ID, meta, now)
+	}
+	return true, nil
+}
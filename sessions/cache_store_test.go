@@ -0,0 +1,334 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cxuhua/xweb/martini"
+	"github.com/gorilla/sessions"
+)
+
+/* Test Helpers */
+func expect(t *testing.T, a interface{}, b interface{}) {
+	if a != b {
+		t.Errorf("Expected %v (type %v) - Got %v (type %v)", b, reflect.TypeOf(b), a, reflect.TypeOf(a))
+	}
+}
+
+func refute(t *testing.T, a interface{}, b interface{}) {
+	if a == b {
+		t.Errorf("Did not expect %v (type %v) - Got %v (type %v)", b, reflect.TypeOf(b), a, reflect.TypeOf(a))
+	}
+}
+
+type memoryCacheItem struct {
+	data []byte
+	exp  time.Time
+}
+
+type memoryCache struct {
+	mu    sync.Mutex
+	items map[string]memoryCacheItem
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{items: map[string]memoryCacheItem{}}
+}
+
+func (c *memoryCache) Set(k string, v interface{}, exp ...time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item := memoryCacheItem{data: v.([]byte)}
+	if len(exp) > 0 {
+		item.exp = time.Now().Add(exp[0])
+	}
+	c.items[k] = item
+	return nil
+}
+
+func (c *memoryCache) Get(k string, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[k]
+	if !ok || (!item.exp.IsZero() && time.Now().After(item.exp)) {
+		return errors.New("miss")
+	}
+	*v.(*[]byte) = item.data
+	return nil
+}
+
+func (c *memoryCache) Del(k ...string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range k {
+		delete(c.items, v)
+	}
+	return int64(len(k)), nil
+}
+
+func (c *memoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func Test_CacheStore(t *testing.T) {
+	cache := newMemoryCache()
+	store := NewCacheStore(cache, []byte("secret123"))
+	m := martini.Classic()
+	m.Use(Sessions("my_session", store))
+	m.Get("/set", func(session Session) string {
+		session.Set("hello", "world")
+		return "OK"
+	})
+	m.Get("/show", func(session Session) string {
+		v, _ := session.Get("hello").(string)
+		return v
+	})
+	m.Get("/login", func(session Session) string {
+		if err := session.Regenerate(); err != nil {
+			t.Error(err)
+		}
+		return "OK"
+	})
+	m.Get("/logout", func(session Session) string {
+		if err := session.Destroy(); err != nil {
+			t.Error(err)
+		}
+		return "OK"
+	})
+	do := func(path string, cookie string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		m.ServeHTTP(res, req)
+		return res
+	}
+	cookie := do("/set", "").Header().Get("Set-Cookie")
+	expect(t, cache.Len(), 1)
+	expect(t, do("/show", cookie).Body.String(), "world")
+
+	// regenerate keeps values under a new ID, the old ID is gone
+	login := do("/login", cookie).Header().Get("Set-Cookie")
+	refute(t, login, cookie)
+	expect(t, cache.Len(), 1)
+	expect(t, do("/show", login).Body.String(), "world")
+	expect(t, do("/show", cookie).Body.String(), "")
+
+	// destroy removes server-side state and expires the cookie
+	res := do("/logout", login)
+	expect(t, cache.Len(), 0)
+	expect(t, res.Result().Cookies()[0].MaxAge, -1)
+	expect(t, do("/show", login).Body.String(), "")
+
+	// idle and absolute timeouts
+	for _, v := range [][2]time.Duration{{time.Nanosecond, 0}, {0, time.Nanosecond}} {
+		store.Timeout(time.Hour, time.Hour)
+		cookie = do("/set", "").Header().Get("Set-Cookie")
+		expect(t, do("/show", cookie).Body.String(), "world")
+		store.Timeout(v[0], v[1])
+		expect(t, do("/show", cookie).Body.String(), "")
+	}
+
+	// a session saved after its absolute deadline is removed, not kept without expiry
+	cache.items = map[string]memoryCacheItem{}
+	store.Timeout(time.Hour, time.Hour)
+	session := sessions.NewSession(store, "my_session")
+	session.Options = &sessions.Options{Path: "/"}
+	session.ID = "expired"
+	session.Values[metaKey{}] = &sessionMeta{Created: time.Now().Add(-time.Hour * 2).Unix()}
+	res = httptest.NewRecorder()
+	expect(t, store.Save(httptest.NewRequest("GET", "/", nil), res, session), nil)
+	expect(t, cache.Len(), 0)
+	// the cookie is expired rather than carrying the dropped ID
+	expect(t, res.Result().Cookies()[0].MaxAge, -1)
+}
+
+type testCart struct {
+	Items []string `json:"items"`
+	Total int      `json:"total"`
+}
+
+func Test_TypedKeys(t *testing.T) {
+	const (
+		name  = StringKey("name")
+		count = IntKey("count")
+		admin = BoolKey("admin")
+		login = TimeKey("login")
+	)
+	cart := ObjectKey{Name: "cart", Version: 2, Upgrade: func(version int, data []byte) ([]byte, error) {
+		// version 1 stored only the item list
+		return []byte(`{"items":` + string(data) + `}`), nil
+	}}
+	now := time.Unix(1700000000, 123)
+	for _, serializer := range []Serializer{GobSerializer{}, JSONSerializer{}} {
+		store := NewCacheStore(newMemoryCache(), []byte("secret123"))
+		store.Serializer(serializer)
+		m := martini.Classic()
+		m.Use(Sessions("my_session", store))
+		m.Get("/set", func(session Session) string {
+			name.Set(session, "alice")
+			count.Set(session, 3)
+			admin.Set(session, true)
+			login.Set(session, now)
+			if err := cart.Set(session, &testCart{Items: []string{"a"}, Total: 1}); err != nil {
+				t.Error(err)
+			}
+			// stored by an older deploy
+			session.Set("old_cart", `{"v":1,"d":["x","y"]}`)
+			return "OK"
+		})
+		m.Get("/show", func(session Session) string {
+			v, ok := name.Get(session)
+			expect(t, ok, true)
+			expect(t, v, "alice")
+			n, ok := count.Get(session)
+			expect(t, ok, true)
+			expect(t, n, int64(3))
+			b, _ := admin.Get(session)
+			expect(t, b, true)
+			tv, _ := login.Get(session)
+			expect(t, tv.Equal(now), true)
+			c := &testCart{}
+			ok, err := cart.Get(session, c)
+			expect(t, ok, true)
+			expect(t, err, nil)
+			expect(t, c.Total, 1)
+			old := ObjectKey{Name: "old_cart", Version: 2, Upgrade: cart.Upgrade}
+			ok, err = old.Get(session, c)
+			expect(t, ok, true)
+			expect(t, err, nil)
+			expect(t, len(c.Items), 2)
+			// version mismatch without Upgrade drops only this value
+			ok, err = ObjectKey{Name: "cart", Version: 3}.Get(session, c)
+			expect(t, ok, false)
+			expect(t, err, ErrSessionVersion)
+			expect(t, session.Get("cart"), nil)
+			return "OK"
+		})
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/set", nil)
+		m.ServeHTTP(res, req)
+		res2 := httptest.NewRecorder()
+		req2, _ := http.NewRequest("GET", "/show", nil)
+		req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
+		m.ServeHTTP(res2, req2)
+		expect(t, res2.Body.String(), "OK")
+	}
+}
+
+func Test_GobSerializerTolerance(t *testing.T) {
+	ss := sessions.NewSession(nil, "s")
+	ss.Values["a"] = "b"
+	ss.Values["n"] = 1
+	data, err := GobSerializer{}.Serialize(ss)
+	expect(t, err, nil)
+	// a value that no longer decodes is dropped, the rest survives
+	entries := []gobEntry{}
+	expect(t, gob.NewDecoder(bytes.NewReader(data)).Decode(&entries), nil)
+	for i := range entries {
+		if entries[i].Key == "n" {
+			entries[i].Value = []byte{0xff, 0x01}
+		}
+	}
+	buf := &bytes.Buffer{}
+	expect(t, gob.NewEncoder(buf).Encode(entries), nil)
+	out := sessions.NewSession(nil, "s")
+	expect(t, GobSerializer{}.Deserialize(buf.Bytes(), out), nil)
+	expect(t, out.Values["a"], "b")
+	expect(t, out.Values["n"], nil)
+}
+
+func Test_SessionIndex(t *testing.T) {
+	store := NewCacheStore(newMemoryCache(), []byte("secret123"))
+	m := martini.Classic()
+	m.Use(Sessions("my_session", store))
+	m.Get("/login", func(session Session) string {
+		if err := session.Regenerate(); err != nil {
+			t.Error(err)
+		}
+		if err := session.Bind("alice"); err != nil {
+			t.Error(err)
+		}
+		session.Set("user", "alice")
+		return "OK"
+	})
+	m.Get("/show", func(session Session) string {
+		v, _ := session.Get("user").(string)
+		return v
+	})
+	m.Get("/logout", func(session Session) string {
+		if err := session.Destroy(); err != nil {
+			t.Error(err)
+		}
+		return "OK"
+	})
+	do := func(path string, cookie string, agent string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", agent)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		m.ServeHTTP(res, req)
+		return res
+	}
+	phone := do("/login", "", "phone").Header().Get("Set-Cookie")
+	laptop := do("/login", "", "laptop").Header().Get("Set-Cookie")
+	tablet := do("/login", "", "tablet").Header().Get("Set-Cookie")
+
+	list, err := store.List("alice")
+	expect(t, err, nil)
+	expect(t, len(list), 3)
+	expect(t, list[0].UserID, "alice")
+	expect(t, list[0].IP, "10.0.0.1")
+	expect(t, list[0].UserAgent, "phone")
+	refute(t, list[0].Handle, "")
+
+	// logout removes the session from the index
+	do("/logout", tablet, "tablet")
+	list, _ = store.List("alice")
+	expect(t, len(list), 2)
+
+	// revoke one session by handle
+	expect(t, store.Revoke("alice", list[0].Handle), nil)
+	expect(t, store.Revoke("alice", list[0].Handle), ErrSessionNotFound)
+	list, _ = store.List("alice")
+	expect(t, len(list), 1)
+	expect(t, list[0].UserAgent, "laptop")
+	expect(t, do("/show", phone, "phone").Body.String(), "")
+	expect(t, do("/show", laptop, "laptop").Body.String(), "alice")
+
+	// revoke all sessions
+	n, err := store.RevokeAll("alice")
+	expect(t, err, nil)
+	expect(t, n, 1)
+	list, _ = store.List("alice")
+	expect(t, len(list), 0)
+	expect(t, do("/show", laptop, "laptop").Body.String(), "")
+
+	// expired sessions are not counted
+	do("/login", "", "phone")
+	do("/login", "", "laptop")
+	entries, err := store.(*cacheStore).readIndex("alice")
+	expect(t, err, nil)
+	expect(t, len(entries), 2)
+	store.(*cacheStore).delete(entries[0].ID)
+	n, err = store.RevokeAll("alice")
+	expect(t, err, nil)
+	expect(t, n, 1)
+
+	// stores without an index reject Bind
+	cs := &session{"my_session", httptest.NewRequest("GET", "/", nil), nil, NewCookieStore([]byte("secret123")), nil, false}
+	expect(t, cs.Bind("alice"), ErrNoIndex)
+}
@@ -0,0 +1,175 @@
+package sessions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cxuhua/xweb/martini"
+)
+
+// ErrNoIndex is returned by Session.Bind when the store keeps no user index.
+var ErrNoIndex = errors.New("sessions: store does not keep a user session index")
+
+// ErrSessionNotFound is returned by CacheStore.Revoke for an unknown handle.
+var ErrSessionNotFound = errors.New("sessions: session not found")
+
+// SessionInfo describes one session of a user. Handle identifies the session
+// for revocation without exposing the session ID.
+type SessionInfo struct {
+	Handle    string    `json:"handle"`
+	UserID    string    `json:"user_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// indexEntry is one element of the user index stored in the Cache.
+type indexEntry struct {
+	ID   string      `json:"id"`
+	Info SessionInfo `json:"info"`
+}
+
+// SessionHandle returns the public handle of a session ID.
+func SessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *cacheStore) indexKey(userID string) string {
+	return s.prefix + "user_" + userID
+}
+
+func (s *cacheStore) readIndex(userID string) ([]indexEntry, error) {
+	var data []byte
+	if err := s.cache.Get(s.indexKey(userID), &data); err != nil || len(data) == 0 {
+		return nil, nil
+	}
+	entries := []indexEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *cacheStore) writeIndex(userID string, entries []indexEntry) error {
+	if len(entries) == 0 {
+		_, err := s.cache.Del(s.indexKey(userID))
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if s.absolute > 0 {
+		return s.cache.Set(s.indexKey(userID), data, s.absolute)
+	}
+	return s.cache.Set(s.indexKey(userID), data)
+}
+
+// index adds or refreshes a session in its user index. The index is updated
+// with read-modify-write, concurrent logins of one user may lose an entry
+// until that session is seen again.
+func (s *cacheStore) index(r *http.Request, id string, meta *sessionMeta, now time.Time) error {
+	entries, err := s.readIndex(meta.UserID)
+	if err != nil {
+		return err
+	}
+	info := SessionInfo{
+		Handle:    SessionHandle(id),
+		UserID:    meta.UserID,
+		IP:        martini.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   time.Unix(meta.Created, 0),
+		LastSeen:  now,
+	}
+	for i := range entries {
+		if entries[i].ID == id {
+			entries[i].Info = info
+			return s.writeIndex(meta.UserID, entries)
+		}
+	}
+	return s.writeIndex(meta.UserID, append(entries, indexEntry{ID: id, Info: info}))
+}
+
+// unindex removes a session from its user index.
+func (s *cacheStore) unindex(id string, meta *sessionMeta) error {
+	if id == "" || meta == nil || meta.UserID == "" {
+		return nil
+	}
+	entries, err := s.readIndex(meta.UserID)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].ID == id {
+			return s.writeIndex(meta.UserID, append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return nil
+}
+
+func (s *cacheStore) alive(id string) bool {
+	var data []byte
+	return s.cache.Get(s.prefix+id, &data) == nil && len(data) > 0
+}
+
+func (s *cacheStore) List(userID string) ([]SessionInfo, error) {
+	entries, err := s.readIndex(userID)
+	if err != nil {
+		return nil, err
+	}
+	alive := entries[:0]
+	list := []SessionInfo{}
+	for _, e := range entries {
+		if s.alive(e.ID) {
+			alive = append(alive, e)
+			list = append(list, e.Info)
+		}
+	}
+	if len(alive) != len(entries) {
+		if err := s.writeIndex(userID, alive); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (s *cacheStore) Revoke(userID string, handle string) error {
+	entries, err := s.readIndex(userID)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.Info.Handle == handle {
+			if err := s.delete(e.ID); err != nil {
+				return err
+			}
+			return s.writeIndex(userID, append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return ErrSessionNotFound
+}
+
+func (s *cacheStore) RevokeAll(userID string) (int, error) {
+	entries, err := s.readIndex(userID)
+	if err != nil {
+		return 0, err
+	}
+	// expired records are dropped from the index but not counted
+	n := 0
+	for _, e := range entries {
+		if !s.alive(e.ID) {
+			continue
+		}
+		if err := s.delete(e.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, s.writeIndex(userID, nil)
+}
@@ -0,0 +1,190 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrSessionVersion is returned by ObjectKey.Get when a stored value has a
+// different version and no Upgrade function is set.
+var ErrSessionVersion = errors.New("sessions: value version mismatch")
+
+// StringKey is a typed session key holding a string.
+//
+//  const UserName = sessions.StringKey("user_name")
+//  UserName.Set(session, "alice")
+//  name, ok := UserName.Get(session)
+type StringKey string
+
+// Get returns the value and whether it was present with the right type.
+func (k StringKey) Get(s Session) (string, bool) {
+	v, ok := s.Get(string(k)).(string)
+	return v, ok
+}
+
+// Set stores v in the session.
+func (k StringKey) Set(s Session, v string) {
+	s.Set(string(k), v)
+}
+
+// Delete removes the value from the session.
+func (k StringKey) Delete(s Session) {
+	s.Delete(string(k))
+}
+
+// IntKey is a typed session key holding an int64. Values decoded by
+// JSONSerializer as float64 or stored as other integer types are converted.
+type IntKey string
+
+// Get returns the value and whether it was present and convertible.
+func (k IntKey) Get(s Session) (int64, bool) {
+	switch v := s.Get(string(k)).(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case float64:
+		return int64(v), float64(int64(v)) == v
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Set stores v in the session.
+func (k IntKey) Set(s Session, v int64) {
+	s.Set(string(k), v)
+}
+
+// Delete removes the value from the session.
+func (k IntKey) Delete(s Session) {
+	s.Delete(string(k))
+}
+
+// BoolKey is a typed session key holding a bool.
+type BoolKey string
+
+// Get returns the value and whether it was present with the right type.
+func (k BoolKey) Get(s Session) (bool, bool) {
+	v, ok := s.Get(string(k)).(bool)
+	return v, ok
+}
+
+// Set stores v in the session.
+func (k BoolKey) Set(s Session, v bool) {
+	s.Set(string(k), v)
+}
+
+// Delete removes the value from the session.
+func (k BoolKey) Delete(s Session) {
+	s.Delete(string(k))
+}
+
+// TimeKey is a typed session key holding a time, stored as RFC 3339 text so
+// that it survives every serializer without loss.
+type TimeKey string
+
+// Get returns the value and whether it was present and parsable.
+func (k TimeKey) Get(s Session) (time.Time, bool) {
+	switch v := s.Get(string(k)).(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case time.Time:
+		return v, true
+	}
+	return time.Time{}, false
+}
+
+// Set stores v in the session.
+func (k TimeKey) Set(s Session, v time.Time) {
+	s.Set(string(k), v.Format(time.RFC3339Nano))
+}
+
+// Delete removes the value from the session.
+func (k TimeKey) Delete(s Session) {
+	s.Delete(string(k))
+}
+
+// objectValue is the stored form of an ObjectKey value.
+type objectValue struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"d"`
+}
+
+// ObjectKey is a session key holding a struct or any JSON-encodable value.
+// The value is stored as versioned JSON text, so structs need no gob
+// registration and fields added or removed between deploys are tolerated.
+// Bump Version for incompatible changes and convert old data in Upgrade.
+//
+//  var Cart = sessions.ObjectKey{Name: "cart", Version: 2, Upgrade: upgradeCart}
+//  err := Cart.Set(session, &cart)
+//  ok, err := Cart.Get(session, &cart)
+type ObjectKey struct {
+	Name    string
+	Version int
+	// Upgrade converts data stored by an older version to the current one.
+	Upgrade func(version int, data []byte) ([]byte, error)
+}
+
+// Get decodes the value into v, it returns false if the value is missing.
+// A value that can not be decoded or upgraded is removed from the session.
+func (k ObjectKey) Get(s Session, v interface{}) (bool, error) {
+	str, ok := s.Get(k.Name).(string)
+	if !ok {
+		return false, nil
+	}
+	ov := &objectValue{}
+	if err := json.Unmarshal([]byte(str), ov); err != nil {
+		s.Delete(k.Name)
+		return false, fmt.Errorf("sessions: decode %s: %v", k.Name, err)
+	}
+	data := []byte(ov.Data)
+	if ov.Version != k.Version {
+		if k.Upgrade == nil {
+			s.Delete(k.Name)
+			return false, ErrSessionVersion
+		}
+		b, err := k.Upgrade(ov.Version, data)
+		if err != nil {
+			s.Delete(k.Name)
+			return false, err
+		}
+		data = b
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		s.Delete(k.Name)
+		return false, fmt.Errorf("sessions: decode %s: %v", k.Name, err)
+	}
+	return true, nil
+}
+
+// Set encodes v as JSON and stores it in the session.
+func (k ObjectKey) Set(s Session, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	str, err := json.Marshal(&objectValue{Version: k.Version, Data: data})
+	if err != nil {
+		return err
+	}
+	s.Set(k.Name, string(str))
+	return nil
+}
+
+// Delete removes the value from the session.
+func (k ObjectKey) Delete(s Session) {
+	s.Delete(k.Name)
+}
@@ -1,6 +1,8 @@
 package sessions
 
 import (
+	"net/http"
+
 	"github.com/boj/redistore"
 	"github.com/gorilla/sessions"
 )
@@ -14,6 +16,8 @@ type RediStore interface {
 	// Options sets the default options for each session stored in this
 	// CookieStore.
 	Options(Options)
+	// Serializer sets the encoding of session values.
+	Serializer(Serializer)
 }
 
 // NewCookieStore returns a new CookieStore.
@@ -49,3 +53,30 @@ func (c *rediStore) Options(options Options) {
 	}
 	c.SetMaxAge(c.RediStore.Options.MaxAge)
 }
+
+func (c *rediStore) Serializer(serializer Serializer) {
+	c.RediStore.SetSerializer(serializer)
+}
+
+// removeID deletes the redis record of session. RediStore deletes through
+// Save with a negative MaxAge, the expired cookie it writes is discarded.
+func (c *rediStore) removeID(r *http.Request, session *sessions.Session) error {
+	old := sessions.NewSession(c, session.Name())
+	old.ID = session.ID
+	old.Options = &sessions.Options{MaxAge: -1}
+	return c.RediStore.Save(r, discardWriter{}, old)
+}
+
+// discardWriter is a ResponseWriter that drops everything written to it.
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardWriter) WriteHeader(int) {
+}
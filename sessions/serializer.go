@@ -0,0 +1,99 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+// Serializer encodes session values for server-side stores. It has the same
+// method set as redistore.SessionSerializer, so one implementation serves both
+// CacheStore and RediStore. Other formats such as msgpack can be plugged in by
+// implementing it.
+type Serializer interface {
+	Serialize(ss *sessions.Session) ([]byte, error)
+	Deserialize(d []byte, ss *sessions.Session) error
+}
+
+// gobEntry is one gob-encoded session value.
+type gobEntry struct {
+	Key   interface{}
+	Value []byte
+}
+
+// GobSerializer encodes every value separately with encoding/gob. A value that
+// no longer decodes, for example because its type was changed or is not
+// registered any more, is dropped without losing the rest of the session.
+type GobSerializer struct{}
+
+func (s GobSerializer) Serialize(ss *sessions.Session) ([]byte, error) {
+	entries := make([]gobEntry, 0, len(ss.Values))
+	for k, v := range ss.Values {
+		if _, ok := k.(metaKey); ok {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(&v); err != nil {
+			return nil, fmt.Errorf("sessions: gob encode %v: %v", k, err)
+		}
+		entries = append(entries, gobEntry{Key: k, Value: buf.Bytes()})
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s GobSerializer) Deserialize(d []byte, ss *sessions.Session) error {
+	entries := []gobEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(d)).Decode(&entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var v interface{}
+		if err := gob.NewDecoder(bytes.NewReader(e.Value)).Decode(&v); err != nil {
+			continue
+		}
+		ss.Values[e.Key] = v
+	}
+	return nil
+}
+
+// JSONSerializer encodes values with encoding/json. Keys must be strings,
+// structs come back as map[string]interface{} and numbers as float64, use the
+// typed keys to read them back.
+type JSONSerializer struct{}
+
+func (s JSONSerializer) Serialize(ss *sessions.Session) ([]byte, error) {
+	m := make(map[string]interface{}, len(ss.Values))
+	for k, v := range ss.Values {
+		if _, ok := k.(metaKey); ok {
+			continue
+		}
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("sessions: non-string key value, cannot serialize session to JSON: %v", k)
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+func (s JSONSerializer) Deserialize(d []byte, ss *sessions.Session) error {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(d, &m); err != nil {
+		return err
+	}
+	for k, raw := range m {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			continue
+		}
+		ss.Values[k] = v
+	}
+	return nil
+}
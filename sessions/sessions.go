@@ -20,6 +20,7 @@
 package sessions
 
 import (
+	"errors"
 	"github.com/cxuhua/xweb/logging"
 	"github.com/cxuhua/xweb/martini"
 	"github.com/gorilla/context"
@@ -36,6 +37,16 @@ type Store interface {
 	sessions.Store
 }
 
+// ErrNoRegenerate is returned by Session.Regenerate when the store keeps
+// server-side state but cannot remove the record under the old ID.
+var ErrNoRegenerate = errors.New("sessions: store cannot regenerate session IDs")
+
+// idRemover is implemented by server-side stores that can delete the record
+// of a session before it is saved under a new ID.
+type idRemover interface {
+	removeID(r *http.Request, session *sessions.Session) error
+}
+
 // Options stores configuration for a session or session store.
 //
 // Fields are a subset of http.Cookie fields.
@@ -70,6 +81,15 @@ type Session interface {
 	Flashes(vars ...string) []interface{}
 	// Options sets confuguration for a session.
 	Options(Options)
+	// Regenerate assigns a new session ID keeping the values, call it after login
+	// to prevent session fixation. Server-side stores remove the old state,
+	// stores that cannot do so return ErrNoRegenerate.
+	Regenerate() error
+	// Destroy removes all values and the server-side state, and expires the cookie.
+	Destroy() error
+	// Bind associates the session with a user so that it can be listed and
+	// revoked through the CacheStore, other stores return ErrNoIndex.
+	Bind(userID string) error
 }
 
 // Sessions is a Middleware that maps a session.Session service into the Martini handler chain.
@@ -121,7 +141,9 @@ func (s *session) Delete(key interface{}) {
 
 func (s *session) Clear() {
 	for key := range s.Session().Values {
-		s.Delete(key)
+		if _, ok := key.(metaKey); !ok {
+			s.Delete(key)
+		}
 	}
 }
 
@@ -145,6 +167,50 @@ func (s *session) Options(options Options) {
 	}
 }
 
+func (s *session) Regenerate() error {
+	ss := s.Session()
+	s.written = true
+	if st, ok := s.store.(CacheStore); ok {
+		return st.Regenerate(ss)
+	}
+	switch st := s.store.(type) {
+	case idRemover:
+		if ss.ID != "" {
+			if err := st.removeID(s.request, ss); err != nil {
+				return err
+			}
+		}
+	case *cookieStore:
+		// the cookie holds all state, there is no old record to remove
+	default:
+		return ErrNoRegenerate
+	}
+	ss.ID = ""
+	return nil
+}
+
+func (s *session) Destroy() error {
+	ss := s.Session()
+	s.written = true
+	if st, ok := s.store.(CacheStore); ok {
+		return st.Destroy(ss)
+	}
+	for key := range ss.Values {
+		delete(ss.Values, key)
+	}
+	ss.Options.MaxAge = -1
+	return nil
+}
+
+func (s *session) Bind(userID string) error {
+	st, ok := s.store.(CacheStore)
+	if !ok {
+		return ErrNoIndex
+	}
+	s.written = true
+	return st.Bind(s.Session(), userID)
+}
+
 func (s *session) Session() *sessions.Session {
 	if s.session == nil {
 		var err error
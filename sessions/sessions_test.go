@@ -1,10 +1,13 @@
 package sessions
 
 import (
+	"github.com/boj/redistore"
 	"github.com/cxuhua/xweb/martini"
+	"github.com/gomodule/redigo/redis"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -184,3 +187,100 @@ func Test_SessionsClear(t *testing.T) {
 	req2.Header.Set("Cookie", res.Header().Get("Set-Cookie"))
 	m.ServeHTTP(res2, req2)
 }
+
+// fakeRedisConn is an in-memory redis.Conn supporting the commands used by RediStore.
+type fakeRedisConn struct {
+	mu   *sync.Mutex
+	data map[string][]byte
+}
+
+func (c fakeRedisConn) Close() error {
+	return nil
+}
+
+func (c fakeRedisConn) Err() error {
+	return nil
+}
+
+func (c fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	return nil
+}
+
+func (c fakeRedisConn) Flush() error {
+	return nil
+}
+
+func (c fakeRedisConn) Receive() (interface{}, error) {
+	return nil, nil
+}
+
+func (c fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return "PONG", nil
+	case "GET":
+		if v, ok := c.data[args[0].(string)]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SETEX":
+		c.data[args[0].(string)] = args[2].([]byte)
+		return "OK", nil
+	case "DEL":
+		delete(c.data, args[0].(string))
+		return int64(1), nil
+	}
+	return nil, nil
+}
+
+type otherStore struct {
+	Store
+}
+
+func Test_RegenerateRedis(t *testing.T) {
+	conn := fakeRedisConn{mu: &sync.Mutex{}, data: map[string][]byte{}}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	rs, err := redistore.NewRediStoreWithPool(pool, []byte("secret123"))
+	expect(t, err, nil)
+	m := martini.Classic()
+	m.Use(Sessions("my_session", &rediStore{rs}))
+	m.Get("/set", func(session Session) string {
+		session.Set("hello", "world")
+		return "OK"
+	})
+	m.Get("/login", func(session Session) string {
+		if err := session.Regenerate(); err != nil {
+			t.Error(err)
+		}
+		return "OK"
+	})
+	m.Get("/show", func(session Session) string {
+		v, _ := session.Get("hello").(string)
+		return v
+	})
+	do := func(path string, cookie string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		m.ServeHTTP(res, req)
+		return res
+	}
+	cookie := do("/set", "").Header().Get("Set-Cookie")
+	expect(t, len(conn.data), 1)
+	login := do("/login", cookie).Header().Get("Set-Cookie")
+	refute(t, login, cookie)
+	// the record under the old ID is deleted, the values move to the new ID
+	expect(t, len(conn.data), 1)
+	expect(t, do("/show", login).Body.String(), "world")
+	expect(t, do("/show", cookie).Body.String(), "")
+
+	// stores that keep server-side state but cannot rotate IDs report it
+	s := &session{"my_session", httptest.NewRequest("GET", "/", nil), nil, otherStore{NewCookieStore([]byte("secret123"))}, nil, false}
+	expect(t, s.Regenerate(), ErrNoRegenerate)
+	s = &session{"my_session", httptest.NewRequest("GET", "/", nil), nil, NewCookieStore([]byte("secret123")), nil, false}
+	expect(t, s.Regenerate(), nil)
+}
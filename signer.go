@@ -2,11 +2,15 @@ package xweb
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,19 +32,77 @@ func RandStr() string {
 	return s
 }
 
-//参数签名处理,暂时只支持json签名,文件数据签名
+//参数签名处理,请求参数和除File外所有Render输出的响应都可以签名,规则见SIGNING.md
 
+//ISigner 签名器,实例保存单个消息的签名状态,不能在请求之间共享
 type ISigner interface {
-	//创建签名
+	//New 使用相同配置创建新的签名状态,每个请求调用一次
+	New() ISigner
+	//创建签名,签名Write写入的数据
 	Create(ads ...string) (string, string, string, error)
-	//验证签名
+	//验证签名,data为需要校验的消息体,与Write写入的数据无关
 	Verify(data []byte, sign string, ts string, nonce string, ads ...string) error
-	//添加签名数据
+	//添加需要签名的数据
 	Write(data []byte) error
 }
 
+//IHeaderSigner 需要读写NF-*以外http头的签名器实现此接口,例如携带key id
+type IHeaderSigner interface {
+	//VerifyHeader 校验h中的签名,data为消息体,req为对应的请求,status为0表示校验请求否则为响应状态
+	VerifyHeader(h http.Header, data []byte, req *http.Request, status int) error
+	//SignHeader 签名Write写入的数据并写入h,req为对应的请求,status为0表示签名请求否则为响应状态
+	SignHeader(h http.Header, req *http.Request, status int) error
+}
+
+//SignResponsePrefix 响应签名字符串前缀,后面是状态码和空格
+const SignResponsePrefix = "RESPONSE "
+
+//签名附加数据,请求为host+method+path,status为0表示请求
+//响应前面加上"RESPONSE "+status+" ",Host头不能包含空格,响应签名不能当作请求签名使用
+func signAds(req *http.Request, status int) []string {
+	if status == 0 {
+		return []string{req.Host, req.Method, req.URL.Path}
+	}
+	return []string{SignResponsePrefix + strconv.Itoa(status) + " ", req.Host, req.Method, req.URL.Path}
+}
+
+//VerifyWithSigner 使用签名器校验h中的签名
+func VerifyWithSigner(sg ISigner, h http.Header, data []byte, req *http.Request, status int) error {
+	if hs, ok := sg.(IHeaderSigner); ok {
+		return hs.VerifyHeader(h, data, req, status)
+	}
+	return sg.Verify(data, h.Get(NF_Signature), h.Get(NF_Timestamp), h.Get(NF_Nonce), signAds(req, status)...)
+}
+
+//SignWithSigner 使用签名器签名Write写入的数据,签名信息写入h
+func SignWithSigner(sg ISigner, h http.Header, req *http.Request, status int) error {
+	if hs, ok := sg.(IHeaderSigner); ok {
+		return hs.SignHeader(h, req, status)
+	}
+	sign, ts, nonce, err := sg.Create(signAds(req, status)...)
+	if err != nil {
+		return err
+	}
+	h.Set(NF_Nonce, nonce)
+	h.Set(NF_Signature, sign)
+	h.Set(NF_Timestamp, ts)
+	return nil
+}
+
 var (
+	//UseSigner 全局签名器原型,每个请求通过New创建独立的签名状态
 	UseSigner ISigner = nil
+	//SignWindow 默认签名时间戳允许误差
+	SignWindow = time.Minute * 5
+)
+
+//签名校验错误
+var (
+	ErrSignEmpty   = errors.New("sign args empty")
+	ErrSignExpired = errors.New("sign timestamp expired")
+	ErrSignReplay  = errors.New("sign nonce replayed")
+	ErrSignInvalid = errors.New("sign invalid")
+	ErrSignKey     = errors.New("sign key invalid")
 )
 
 //签名用http头
@@ -48,11 +110,58 @@ const (
 	NF_Nonce     = "NF-Nonce"     //随机字符串 32字节
 	NF_Timestamp = "NF-Timestamp" //时间戳
 	NF_Signature = "NF-Signature" //签名
+	NF_KeyId     = "NF-Key-Id"    //签名密钥id
 )
 
+//SignReplay 签名重放保护配置
+type SignReplay struct {
+	//时间戳允许误差,为0使用SignWindow,小于0不检测
+	Window time.Duration
+	//已使用的nonce存储,为nil不检测nonce重复
+	Nonces ICache
+}
+
+//检测时间戳是否在允许范围内,返回nonce需要保存的时间
+func (sr SignReplay) checkTimestamp(ts string) (time.Duration, error) {
+	if sr.Window < 0 {
+		return 0, nil
+	}
+	window := sr.Window
+	if window == 0 {
+		window = SignWindow
+	}
+	tv, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return 0, ErrSignExpired
+	}
+	tp := time.Unix(tv, 0)
+	now := time.Now()
+	if now.Sub(tp) > window || tp.Sub(now) > window {
+		return 0, ErrSignExpired
+	}
+	//nonce在时间戳有效期内保存
+	return tp.Add(window).Sub(now), nil
+}
+
+//检测nonce是否已经使用过
+func (sr SignReplay) checkNonce(nonce string, ttl time.Duration) error {
+	if sr.Nonces == nil {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = SignWindow
+	}
+	//锁存在说明nonce已经使用过
+	if _, err := sr.Nonces.Locker("_nf_nonce_"+nonce, ttl); err != nil {
+		return ErrSignReplay
+	}
+	return nil
+}
+
 type standsigner struct {
-	key string
-	buf *bytes.Buffer
+	key    string
+	buf    *bytes.Buffer
+	replay SignReplay
 }
 
 func (ss *standsigner) getAds(ads ...string) string {
@@ -62,15 +171,15 @@ func (ss *standsigner) getAds(ads ...string) string {
 func (ss *standsigner) Create(ads ...string) (string, string, string, error) {
 	nonce := RandStr()
 	ts := fmt.Sprintf("%d", time.Now().Unix())
-	sign, err := ss.getSign(ts, nonce, ads...)
+	sign, err := ss.getSign(ss.buf.Bytes(), ts, nonce, ads...)
 	if err != nil {
 		return "", "", "", err
 	}
 	return sign, ts, nonce, nil
 }
 
-//sha256(host+post+path+sha256(body)+key)
-func (ss *standsigner) getSign(ts string, nonce string, ads ...string) (string, error) {
+//sha256(host+post+path+nonce+ts+sha256(body)+key)
+func (ss *standsigner) getSign(body []byte, ts string, nonce string, ads ...string) (string, error) {
 	adss := ss.getAds(ads...)
 	if adss == "" {
 		return "", fmt.Errorf("adss emtpy")
@@ -81,7 +190,7 @@ func (ss *standsigner) getSign(ts string, nonce string, ads ...string) (string,
 	if err != nil {
 		return "", err
 	}
-	bhash := sha256.Sum256(ss.buf.Bytes())
+	bhash := sha256.Sum256(body)
 	_, err = sbb.Write([]byte(hex.EncodeToString(bhash[:])))
 	if err != nil {
 		return "", err
@@ -96,18 +205,26 @@ func (ss *standsigner) getSign(ts string, nonce string, ads ...string) (string,
 }
 
 func (ss *standsigner) Verify(data []byte, sign string, ts string, nonce string, ads ...string) error {
-	_, _ = ss.buf.Write(data)
 	if sign == "" || ts == "" || nonce == "" {
-		return fmt.Errorf("sign args empty")
+		return ErrSignEmpty
+	}
+	ttl, err := ss.replay.checkTimestamp(ts)
+	if err != nil {
+		return err
 	}
-	ssg, err := ss.getSign(ts, nonce, ads...)
+	ssg, err := ss.getSign(data, ts, nonce, ads...)
 	if err != nil {
 		return err
 	}
-	if ssg != sign {
-		return fmt.Errorf("sign %s error", sign)
+	if !hmac.Equal([]byte(ssg), []byte(sign)) {
+		return ErrSignInvalid
 	}
-	return nil
+	//签名正确后再记录nonce,防止伪造请求占用nonce
+	return ss.replay.checkNonce(nonce, ttl)
+}
+
+func (ss *standsigner) New() ISigner {
+	return &standsigner{key: ss.key, buf: &bytes.Buffer{}, replay: ss.replay}
 }
 
 func (ss *standsigner) Write(data []byte) error {
@@ -115,6 +232,11 @@ func (ss *standsigner) Write(data []byte) error {
 	return err
 }
 
-func NewStandSigner(key string) ISigner {
-	return &standsigner{key: key, buf: &bytes.Buffer{}}
+//NewStandSigner 创建默认签名器,replay设置时间戳误差和nonce存储
+func NewStandSigner(key string, replay ...SignReplay) ISigner {
+	ss := &standsigner{key: key, buf: &bytes.Buffer{}}
+	if len(replay) > 0 {
+		ss.replay = replay[0]
+	}
+	return ss
 }
@@ -0,0 +1,194 @@
+package xweb
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//snappy块格式实现,只支持块格式不支持流格式,与其他snappy实现的块数据兼容
+//编码只查找64KB以内的重复数据,速度优先
+
+var (
+	//ErrSnappyCorrupt snappy数据错误
+	ErrSnappyCorrupt = errors.New("snappy: corrupt input")
+)
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+	//最短匹配长度
+	snappyMinMatch = 4
+	//最大匹配偏移,使用2字节偏移
+	snappyMaxOffset = 1 << 16
+	snappyTableBits = 14
+)
+
+type snappyCodec struct {
+}
+
+func (c snappyCodec) ID() byte {
+	return CodecSnappy
+}
+
+func (c snappyCodec) Encode(b []byte) ([]byte, error) {
+	return snappyEncode(b), nil
+}
+
+func (c snappyCodec) Decode(b []byte) ([]byte, error) {
+	return snappyDecode(b)
+}
+
+//SnappyCodec snappy块格式快速压缩,压缩率低于flate,适合热点数据
+func SnappyCodec() ICodec {
+	return snappyCodec{}
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+//输出字面量
+func snappyLiteral(dst []byte, lit []byte) []byte {
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+//输出复制,offset小于snappyMaxOffset
+func snappyCopy(dst []byte, offset int, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+//snappy块格式编码
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)/2+binary.MaxVarintLen64)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	if len(src) < snappyMinMatch+1 {
+		if len(src) > 0 {
+			dst = snappyLiteral(dst, src)
+		}
+		return dst
+	}
+	var table [1 << snappyTableBits]int32
+	lit := 0
+	s := 0
+	end := len(src) - snappyMinMatch
+	for s <= end {
+		u := binary.LittleEndian.Uint32(src[s:])
+		h := snappyHash(u)
+		c := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if c < 0 || s-c >= snappyMaxOffset || binary.LittleEndian.Uint32(src[c:]) != u {
+			s++
+			continue
+		}
+		if lit < s {
+			dst = snappyLiteral(dst, src[lit:s])
+		}
+		n := snappyMinMatch
+		for s+n < len(src) && src[c+n] == src[s+n] {
+			n++
+		}
+		dst = snappyCopy(dst, s-c, n)
+		s += n
+		lit = s
+	}
+	if lit < len(src) {
+		dst = snappyLiteral(dst, src[lit:])
+	}
+	return dst
+}
+
+//snappy块格式解码
+func snappyDecode(src []byte) ([]byte, error) {
+	dl, n := binary.Uvarint(src)
+	if n <= 0 || dl > uint64(len(src))*255 {
+		return nil, ErrSnappyCorrupt
+	}
+	dst := make([]byte, 0, dl)
+	s := n
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := int(tag >> 2)
+			s++
+			if x >= 60 {
+				nb := x - 59
+				if s+nb > len(src) {
+					return nil, ErrSnappyCorrupt
+				}
+				x = 0
+				for i := nb - 1; i >= 0; i-- {
+					x = x<<8 | int(src[s+i])
+				}
+				s += nb
+			}
+			length = x + 1
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(dl) {
+				return nil, ErrSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(dl) {
+			return nil, ErrSnappyCorrupt
+		}
+		//复制区域可能重叠,逐字节复制
+		p := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[p+i])
+		}
+	}
+	if len(dst) != int(dl) {
+		return nil, ErrSnappyCorrupt
+	}
+	return dst, nil
+}
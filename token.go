@@ -0,0 +1,355 @@
+package xweb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//token编码方式
+const (
+	TokenModeEncrypt = iota //AES-GCM加密,内容不可见,使用TokenEncrypt
+	TokenModeJWT            //JWT签名,支持HS256,HS512,EdDSA
+)
+
+var (
+	//TokenSkew 校验时间允许误差
+	TokenSkew = time.Minute
+	//token校验错误
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenNotBefore = errors.New("token not valid yet")
+	ErrTokenIssuer    = errors.New("token issuer invalid")
+	ErrTokenAudience  = errors.New("token audience invalid")
+	ErrTokenRevoked   = errors.New("token revoked")
+)
+
+//ClaimStrings 字符串或字符串数组声明,例如aud,只有一个值时编码为字符串
+type ClaimStrings []string
+
+func (cs ClaimStrings) MarshalJSON() ([]byte, error) {
+	if len(cs) == 1 {
+		return json.Marshal(cs[0])
+	}
+	return json.Marshal([]string(cs))
+}
+
+func (cs *ClaimStrings) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*cs = ClaimStrings{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return err
+	}
+	*cs = ClaimStrings(ss)
+	return nil
+}
+
+//Contains 是否包含s
+func (cs ClaimStrings) Contains(s string) bool {
+	for _, v := range cs {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//TokenClaims token声明,字段名与JWT标准声明相同
+//其他顶层声明保存在Extra,例如其他签发者的roles和perms
+type TokenClaims struct {
+	ID        string                 `json:"jti,omitempty"`
+	Issuer    string                 `json:"iss,omitempty"`
+	Subject   string                 `json:"sub,omitempty"`
+	Audience  ClaimStrings           `json:"aud,omitempty"`
+	ExpiresAt int64                  `json:"exp,omitempty"`
+	NotBefore int64                  `json:"nbf,omitempty"`
+	IssuedAt  int64                  `json:"iat,omitempty"`
+	Extra     map[string]interface{} `json:"-"`
+}
+
+//JWT标准声明,不能作为扩展声明
+var tokenStdClaims = map[string]bool{
+	"jti": true, "iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true,
+}
+
+//没有扩展方法的声明,用于编码标准声明
+type stdTokenClaims TokenClaims
+
+//MarshalJSON 扩展声明和标准声明编码在同一层
+func (c *TokenClaims) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal((*stdTokenClaims)(c))
+	if err != nil || len(c.Extra) == 0 {
+		return b, err
+	}
+	std := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &std); err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	for k, v := range c.Extra {
+		if !tokenStdClaims[k] {
+			m[k] = v
+		}
+	}
+	for k, v := range std {
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+//UnmarshalJSON 标准声明以外的顶层声明保存到Extra
+func (c *TokenClaims) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*stdTokenClaims)(c)); err != nil {
+		return err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for k, v := range m {
+		if !tokenStdClaims[k] {
+			c.Set(k, v)
+		}
+	}
+	return nil
+}
+
+//Get 获取扩展声明
+func (c *TokenClaims) Get(k string) (interface{}, bool) {
+	v, ok := c.Extra[k]
+	return v, ok
+}
+
+//Set 设置扩展声明
+func (c *TokenClaims) Set(k string, v interface{}) {
+	if c.Extra == nil {
+		c.Extra = map[string]interface{}{}
+	}
+	c.Extra[k] = v
+}
+
+//TokenOptions token配置
+type TokenOptions struct {
+	//编码方式
+	Mode int
+	//签发者,签发时为空使用此值,校验时不为空需要相同
+	Issuer string
+	//接收者,签发时为空使用此值,校验时不为空需要包含在aud中
+	Audience string
+	//时间允许误差,为0使用TokenSkew
+	Skew time.Duration
+	//已撤销的token id存储,为nil不检测
+	Revoked ICache
+	//JWT签名密钥,hmac-sha256,hmac-sha512,ed25519
+	Keys *Keyring
+}
+
+func (opt TokenOptions) skew() time.Duration {
+	if opt.Skew == 0 {
+		return TokenSkew
+	}
+	return opt.Skew
+}
+
+func getTokenOptions(opts []TokenOptions) TokenOptions {
+	if len(opts) > 0 {
+		return opts[0]
+	}
+	return TokenOptions{}
+}
+
+//撤销记录key
+func tokenRevokeKey(id string) string {
+	return "_tk_revoke_" + id
+}
+
+//IssueToken 签发token,ttl<=0不过期,没有设置ID时生成随机ID
+func IssueToken(claims *TokenClaims, ttl time.Duration, opts ...TokenOptions) (string, error) {
+	opt := getTokenOptions(opts)
+	c := *claims
+	now := time.Now()
+	if c.ID == "" {
+		c.ID = RandStr()
+	}
+	if c.Issuer == "" {
+		c.Issuer = opt.Issuer
+	}
+	if len(c.Audience) == 0 && opt.Audience != "" {
+		c.Audience = ClaimStrings{opt.Audience}
+	}
+	c.IssuedAt = now.Unix()
+	if ttl > 0 {
+		c.ExpiresAt = now.Add(ttl).Unix()
+	}
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	if opt.Mode == TokenModeJWT {
+		return jwtEncode(opt.Keys, data)
+	}
+	return TokenEncrypt(string(data))
+}
+
+//ParseToken 解析并校验token
+func ParseToken(token string, opts ...TokenOptions) (*TokenClaims, error) {
+	opt := getTokenOptions(opts)
+	var data []byte
+	if opt.Mode == TokenModeJWT {
+		b, err := jwtDecode(opt.Keys, token)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	} else {
+		s, err := TokenDecrypt(token)
+		if err != nil {
+			return nil, ErrTokenInvalid
+		}
+		data = []byte(s)
+	}
+	c := &TokenClaims{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if err := c.Valid(opt); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Valid 校验时间,签发者,接收者和撤销状态
+func (c *TokenClaims) Valid(opt TokenOptions) error {
+	now := time.Now().Unix()
+	skew := int64(opt.skew() / time.Second)
+	if c.ExpiresAt > 0 && now > c.ExpiresAt+skew {
+		return ErrTokenExpired
+	}
+	if c.NotBefore > 0 && now+skew < c.NotBefore {
+		return ErrTokenNotBefore
+	}
+	if c.IssuedAt > now+skew {
+		return ErrTokenNotBefore
+	}
+	if opt.Issuer != "" && c.Issuer != opt.Issuer {
+		return ErrTokenIssuer
+	}
+	if opt.Audience != "" && !c.Audience.Contains(opt.Audience) {
+		return ErrTokenAudience
+	}
+	if opt.Revoked != nil && c.ID != "" {
+		var v []byte
+		if err := opt.Revoked.Get(tokenRevokeKey(c.ID), &v); err == nil {
+			return ErrTokenRevoked
+		}
+	}
+	return nil
+}
+
+//RevokeToken 撤销token,记录保存到token过期,不过期的token保存ttl时间
+func RevokeToken(c *TokenClaims, ttl time.Duration, opts ...TokenOptions) error {
+	opt := getTokenOptions(opts)
+	if opt.Revoked == nil {
+		return errors.New("token revoked cache not set")
+	}
+	if c.ID == "" {
+		return ErrTokenInvalid
+	}
+	if c.ExpiresAt > 0 {
+		ttl = time.Until(time.Unix(c.ExpiresAt, 0)) + opt.skew()
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	return opt.Revoked.Set(tokenRevokeKey(c.ID), []byte{1}, ttl)
+}
+
+//签名算法对应的JWT alg
+var jwtAlgs = map[string]string{
+	SignAlgHMACSHA256: "HS256",
+	SignAlgHMACSHA512: "HS512",
+	SignAlgEd25519:    "EdDSA",
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+//JWT编码,使用密钥环中第一个KeyActive状态的密钥签名
+func jwtEncode(kr *Keyring, payload []byte) (string, error) {
+	if kr == nil {
+		return "", ErrSignKey
+	}
+	key, err := kr.Active()
+	if err != nil {
+		return "", err
+	}
+	alg, ok := jwtAlgs[key.alg()]
+	if !ok {
+		return "", ErrSignKey
+	}
+	hb, err := json.Marshal(&jwtHeader{Alg: alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	s := enc.EncodeToString(hb) + "." + enc.EncodeToString(payload)
+	sign, err := key.SignBytes([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return s + "." + enc.EncodeToString(sign), nil
+}
+
+//JWT解码,通过kid选择密钥,alg需要与密钥算法一致
+func jwtDecode(kr *Keyring, token string) ([]byte, error) {
+	if kr == nil {
+		return nil, ErrSignKey
+	}
+	ps := strings.Split(token, ".")
+	if len(ps) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	enc := base64.RawURLEncoding
+	hb, err := enc.DecodeString(ps[0])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	h := &jwtHeader{}
+	if err := json.Unmarshal(hb, h); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	var key *SignKey
+	if h.Kid == "" {
+		key, err = kr.Active()
+	} else if k, ok := kr.Get(h.Kid); ok {
+		key = k
+	} else {
+		err = ErrSignKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.State == KeyRetired || jwtAlgs[key.alg()] != h.Alg {
+		return nil, ErrSignKey
+	}
+	sign, err := enc.DecodeString(ps[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if err := key.VerifyBytes([]byte(ps[0]+"."+ps[1]), sign); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	payload, err := enc.DecodeString(ps[1])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	return payload, nil
+}
@@ -13,9 +13,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/cxuhua/lzma"
 	"github.com/cxuhua/xweb/logging"
 	"github.com/cxuhua/xweb/martini"
+	"github.com/cxuhua/xweb/sessions"
 )
 
 type IModel interface {
@@ -178,9 +178,10 @@ func NewStringModel() *StringModel {
 //content model
 type ContentModel struct {
 	xModel
-	Key  string
-	Type string
-	Data []byte
+	Key    string
+	Type   string
+	Data   []byte
+	Status int //输出状态,为0使用mvc设置的状态
 }
 
 func (this *ContentModel) Finished() {
@@ -402,6 +403,16 @@ type CacheParams struct {
 	//延迟超时时间，如果设置ttl和dtl>0，当key得时间少于dtl时就算过期
 	//TTL+DTL就是实际缓存时间
 	DTL time.Duration
+	//是否允许共享缓存(代理,CDN)缓存,默认只允许客户端缓存
+	Public bool
+	//压缩编码器,为nil使用DefaultCodec
+	Codec ICodec
+	//事件观察者,为nil使用CacheObserver
+	Observer ICacheObserver
+	//需要缓存的响应头,为nil使用CacheHeaders
+	Headers []string
+	//状态是否可以缓存,为nil使用DefaultCacheable
+	Cacheable func(status int) bool
 	//是否跳过setbytes缓存数据
 	skip bool
 }
@@ -421,6 +432,19 @@ func (cp *CacheParams) Skip(sv bool) {
 	cp.skip = sv
 }
 
+//发送缓存事件
+func (cp *CacheParams) emit(ev *CacheEvent) {
+	ob := cp.Observer
+	if ob == nil {
+		ob = CacheObserver
+	}
+	if ob == nil {
+		return
+	}
+	ev.Key = cp.Key
+	ob.OnCacheEvent(ev)
+}
+
 //Remove 删除缓存
 func (cp *CacheParams) Remove() {
 	cp.Imp.Del(cp.Key)
@@ -544,18 +568,24 @@ func (cp *CacheParams) Prepare(ttl time.Duration, try ...int) (ILocker, []byte,
 	hasbb := err == nil
 	//如果有并且没有过期就直接返回
 	if hasbb && !cp.IsExpire() {
+		cp.emit(&CacheEvent{Type: CacheEventHit})
 		return nil, bb, 1, nil
 	}
 	//如果不启用锁并且没有数据
 	if ttl == 0 && !hasbb {
+		cp.emit(&CacheEvent{Type: CacheEventMiss})
 		return nil, nil, 0, nil
 	}
 	//加锁确保后续fn不会重复被执行
 	lck, err := cp.Imp.Locker(cp.LockerKey(), ttl)
 	//锁失败并且有旧数据返回旧数据
 	if err != nil && hasbb {
+		cp.emit(&CacheEvent{Type: CacheEventStale})
 		return nil, bb, 2, nil
 	}
+	if err != nil {
+		cp.emit(&CacheEvent{Type: CacheEventLockWait})
+	}
 	//尝试再次获取数据和锁
 	for tc, tv := PTP(try...); err != nil && tc > 0; tc-- {
 		//休眠后尝试
@@ -563,14 +593,17 @@ func (cp *CacheParams) Prepare(ttl time.Duration, try ...int) (ILocker, []byte,
 		//尝试期间如果有缓存数据
 		bb, err = cp.GetBytes()
 		if err == nil {
+			cp.emit(&CacheEvent{Type: CacheEventWaitHit})
 			return nil, bb, 3, nil
 		}
 		lck, err = cp.Imp.Locker(cp.LockerKey(), ttl)
 	}
 	//尝试多次未获取锁失败返回错误
 	if err != nil {
+		cp.emit(&CacheEvent{Type: CacheEventLockTimeout, Err: err})
 		return nil, nil, 0, err
 	}
+	cp.emit(&CacheEvent{Type: CacheEventMiss})
 	return lck, nil, 0, nil
 }
 
@@ -608,21 +641,7 @@ func (cp *CacheParams) GetBytes() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
-		return nil, fmt.Errorf("empty content")
-	}
-	//非SetBytes设置的
-	if b[0] != 0 && b[0] != 1 {
-		return b, nil
-	}
-	if b[0] == 0 {
-		return b[1:], nil
-	}
-	v, err := lzma.Uncompress(b[1:])
-	if err != nil {
-		return nil, err
-	}
-	return v, nil
+	return decodeWithCodec(b)
 }
 
 //IsExpire 是否过期
@@ -653,27 +672,61 @@ func (cp *CacheParams) IsExpire() bool {
 	return false
 }
 
-//SetBytes 保存字符串,第一字节存放是否被压缩
+//CacheControl 根据TTL和DTL生成Cache-Control头
+func (cp *CacheParams) CacheControl() string {
+	scope := "private"
+	if cp.Public {
+		scope = "public"
+	}
+	if cp.TTL <= 0 {
+		return scope + ", no-cache"
+	}
+	cc := fmt.Sprintf("%s, max-age=%d", scope, int64(cp.TTL/time.Second))
+	if cp.DTL > 0 {
+		cc += fmt.Sprintf(", stale-while-revalidate=%d", int64(cp.DTL/time.Second))
+	}
+	return cc
+}
+
+//ModTime 根据剩余缓存时间推算数据保存时间,无法获取时返回当前时间
+func (cp *CacheParams) ModTime() time.Time {
+	now := time.Now()
+	dv, err := cp.Imp.TTL(cp.Key)
+	if err != nil || dv <= 0 {
+		return now
+	}
+	if age := cp.TTL + cp.DTL - dv; age > 0 {
+		return now.Add(-age)
+	}
+	return now
+}
+
+//SetBytes 保存字符串,第一字节存放压缩编码id
 func (cp *CacheParams) SetBytes(sb []byte) error {
 	//如果跳过覆盖缓存数据直接返回成功
 	if cp.skip {
 		return nil
 	}
-	var vb []byte
+	var c ICodec = noneCodec{}
 	if len(sb) > MinZipSize {
-		zb, err := lzma.Compress(sb)
-		if err != nil {
-			return err
+		c = cp.Codec
+		if c == nil {
+			c = DefaultCodec
 		}
-		vb = make([]byte, len(zb)+1)
-		vb[0] = 1
-		copy(vb[1:], zb)
-	} else {
-		vb = make([]byte, len(sb)+1)
-		vb[0] = 0
-		copy(vb[1:], sb)
 	}
-	return cp.Imp.Set(cp.Key, vb, cp.TTL+cp.DTL)
+	vb, err := encodeWithCodec(c, sb)
+	if err != nil {
+		cp.emit(&CacheEvent{Type: CacheEventSetError, Codec: c.ID(), Err: err})
+		return err
+	}
+	if c.ID() != CodecNone {
+		cp.emit(&CacheEvent{Type: CacheEventCompress, Codec: c.ID(), Size: len(sb), ZipSize: len(vb) - 1})
+	}
+	err = cp.Imp.Set(cp.Key, vb, cp.TTL+cp.DTL)
+	if err != nil {
+		cp.emit(&CacheEvent{Type: CacheEventSetError, Codec: c.ID(), Err: err})
+	}
+	return err
 }
 
 //IMVC mvc控制接口
@@ -708,6 +761,8 @@ type IMVC interface {
 	Cookie(name string) (*http.Cookie, error)
 	Request() *http.Request
 	RemoteAddr() string
+	//会话,没有使用sessions.Sessions返回nil
+	Session() sessions.Session
 	URL() *url.URL
 	Header() http.Header
 	Method() string
@@ -764,6 +819,10 @@ func (this *xmvc) RemoteAddr() string {
 	return GetRemoteAddr(this.req)
 }
 
+func (this *xmvc) Session() sessions.Session {
+	return GetSession(this.ctx)
+}
+
 func (this *xmvc) Render() Render {
 	return this.rev
 }
@@ -842,6 +901,9 @@ func (this *xmvc) RunRender() {
 		if !b {
 			panic("RENDER Model error:must set ContentModel")
 		}
+		if v.Status > 0 {
+			this.status = v.Status
+		}
 		this.rev.Header().Set(ContentLength, fmt.Sprintf("%d", len(v.Data)))
 		this.rev.Header().Set(ContentType, v.Type)
 		this.rev.Data(this.status, v.Data)
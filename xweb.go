@@ -1,6 +1,7 @@
 package xweb
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/cxuhua/xweb/logging"
 	"github.com/cxuhua/xweb/martini"
+	"github.com/cxuhua/xweb/sessions"
 )
 
 var (
@@ -108,6 +110,19 @@ type IDispatcher interface {
 	AfterHandler() martini.Handler
 }
 
+//ISignerDispatcher 分发器实现此接口使用独立的签名器,返回nil使用UseSigner
+type ISignerDispatcher interface {
+	Signer() ISigner
+}
+
+//获取分发器使用的签名器原型
+func (ctx *HttpContext) dispatcherSigner(c IDispatcher) ISigner {
+	if sd, ok := c.(ISignerDispatcher); ok {
+		return sd.Signer()
+	}
+	return nil
+}
+
 //默认http mvc dispatcher定义
 type HTTPDispatcher struct {
 	IDispatcher
@@ -149,16 +164,14 @@ func (ctx *HTTPDispatcher) URL() string {
 
 //获取远程地址
 func GetRemoteAddr(req *http.Request) string {
-	if x := req.Header.Get("X-Forwarded-For"); x != "" {
-		return strings.Split(x, ",")[0]
-	}
-	if x := req.Header.Get("X-Real-IP"); x != "" {
-		return strings.Split(x, ",")[0]
-	}
-	if x := strings.Split(req.RemoteAddr, ":"); len(x) > 0 {
-		return x[0]
-	}
-	return req.RemoteAddr
+	return martini.ClientIP(req)
+}
+
+//SetTrustedProxies 设置可信代理,只有来自可信代理的请求才使用X-Forwarded-For,Forwarded和X-Real-IP
+//默认只信任本机代理
+//	xweb.SetTrustedProxies("10.0.0.0/8", "fd00::/8")
+func SetTrustedProxies(cidrs ...string) error {
+	return martini.DefaultIPResolver.SetTrustedProxies(cidrs...)
 }
 
 //默认处理方法
@@ -254,6 +267,9 @@ func hasParseTag(tf reflect.StructField) bool {
 	if hasTag("header", tf) {
 		return true
 	}
+	if hasTag("session", tf) {
+		return true
+	}
 	return false
 }
 
@@ -302,7 +318,8 @@ func setFileValue(files map[string][]*multipart.FileHeader, name string, sf refl
 	}
 }
 
-func MapFormBindValue(value reflect.Value, form url.Values, files map[string][]*multipart.FileHeader, urls url.Values, cookies url.Values, header url.Values) {
+//sess可选,绑定session tag,session字段只从会话获取,会话中没有时为零值
+func MapFormBindValue(value reflect.Value, form url.Values, files map[string][]*multipart.FileHeader, urls url.Values, cookies url.Values, header url.Values, sess ...sessions.Session) {
 	value = reflect.Indirect(value)
 	vtyp := value.Type()
 	for i := 0; i < vtyp.NumField(); i++ {
@@ -313,10 +330,10 @@ func MapFormBindValue(value reflect.Value, form url.Values, files map[string][]*
 		}
 		if tf.Type.Kind() == reflect.Ptr {
 			ele := reflect.New(tf.Type.Elem())
-			MapFormBindValue(ele.Elem(), form, files, urls, cookies, header)
+			MapFormBindValue(ele.Elem(), form, files, urls, cookies, header, sess...)
 			sf.Set(ele)
 		} else if tf.Type.Kind() == reflect.Struct && tf.Type != FormFileType {
-			MapFormBindValue(sf, form, files, urls, cookies, header)
+			MapFormBindValue(sf, form, files, urls, cookies, header, sess...)
 		} else if name := tf.Tag.Get("form"); (len(form) > 0 || len(files) > 0) && name != "-" && name != "" {
 			setInputValue(form, name, sf, tf)
 			setFileValue(files, name, sf, tf)
@@ -326,6 +343,12 @@ func MapFormBindValue(value reflect.Value, form url.Values, files map[string][]*
 			setInputValue(header, name, sf, tf)
 		} else if name := tf.Tag.Get("cookie"); len(cookies) > 0 && name != "-" && name != "" {
 			setInputValue(cookies, name, sf, tf)
+		} else if name := tf.Tag.Get("session"); name != "-" && name != "" {
+			var ss sessions.Session
+			if len(sess) > 0 {
+				ss = sess[0]
+			}
+			setSessionValue(ss, name, sf, tf)
 		}
 	}
 }
@@ -338,18 +361,18 @@ func (ctx *HttpContext) GetBody(req *http.Request) ([]byte, error) {
 	return ioutil.ReadAll(req.Body)
 }
 
-func (ctx *HttpContext) newURLArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger) IArgs {
+func (ctx *HttpContext) newURLArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger, sess sessions.Session) IArgs {
 	t := reflect.TypeOf(iv).Elem()
 	v := reflect.New(t)
 	args, ok := v.Interface().(IArgs)
 	if !ok {
 		panic(errors.New(t.Name() + "not imp URLArgs"))
 	}
-	UnmarshalURLCookie(args, param, req)
+	UnmarshalURLCookie(args, param, req, sess)
 	return args
 }
 
-func UnmarshalForm(iv IArgs, param martini.Params, req *http.Request, log *logging.Logger) {
+func UnmarshalForm(iv IArgs, param martini.Params, req *http.Request, log *logging.Logger, sess ...sessions.Session) {
 	v := reflect.ValueOf(iv)
 	ct := strings.ToLower(req.Header.Get(ContentType))
 	//
@@ -381,7 +404,7 @@ func UnmarshalForm(iv IArgs, param martini.Params, req *http.Request, log *loggi
 					log.Info(k, ":", v)
 				}
 			}
-			MapFormBindValue(v, req.MultipartForm.Value, req.MultipartForm.File, uv, cv, hv)
+			MapFormBindValue(v, req.MultipartForm.Value, req.MultipartForm.File, uv, cv, hv, sess...)
 		} else {
 			log.Error("parse multipart form error", err)
 		}
@@ -394,24 +417,36 @@ func UnmarshalForm(iv IArgs, param martini.Params, req *http.Request, log *loggi
 				log.Info(k, ":", v)
 			}
 		}
-		MapFormBindValue(v, req.Form, nil, uv, cv, hv)
+		MapFormBindValue(v, req.Form, nil, uv, cv, hv, sess...)
 	} else {
 		log.Error("parse form error", err)
 	}
 }
 
-func (ctx *HttpContext) newFormArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger) IArgs {
+func (ctx *HttpContext) newFormArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger, sess sessions.Session) IArgs {
 	t := reflect.TypeOf(iv).Elem()
 	v := reflect.New(t)
 	args, ok := v.Interface().(IArgs)
 	if !ok {
 		panic(errors.New(t.Name() + "not imp FORMArgs"))
 	}
-	UnmarshalForm(args, param, req, log)
+	//urlencoded数据读取后重新设置,原始数据用于签名校验
+	ct := strings.ToLower(req.Header.Get(ContentType))
+	if req.Body != nil && strings.Contains(ct, ContentURLEncoded) {
+		data, err := ctx.GetBody(req)
+		if err != nil {
+			log.Error(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if err := args.PutSignBytes(data); err != nil {
+			log.Error(err)
+		}
+	}
+	UnmarshalForm(args, param, req, log, sess)
 	return args
 }
 
-func UnmarshalURLCookie(iv IArgs, param martini.Params, req *http.Request) {
+func UnmarshalURLCookie(iv IArgs, param martini.Params, req *http.Request, sess ...sessions.Session) {
 	v := reflect.ValueOf(iv)
 	uv := req.URL.Query()
 	for k, v := range param {
@@ -427,10 +462,10 @@ func UnmarshalURLCookie(iv IArgs, param martini.Params, req *http.Request) {
 			hv.Add(k, v)
 		}
 	}
-	MapFormBindValue(v, nil, nil, uv, cv, hv)
+	MapFormBindValue(v, nil, nil, uv, cv, hv, sess...)
 }
 
-func (ctx *HttpContext) newJSONArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger) IArgs {
+func (ctx *HttpContext) newJSONArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger, sess sessions.Session) IArgs {
 	t := reflect.TypeOf(iv).Elem()
 	v := reflect.New(t)
 	args, ok := v.Interface().(IArgs)
@@ -450,11 +485,11 @@ func (ctx *HttpContext) newJSONArgs(iv IArgs, req *http.Request, param martini.P
 	if err := json.Unmarshal(data, args); err != nil {
 		log.Error(err)
 	}
-	UnmarshalURLCookie(args, param, req)
+	UnmarshalURLCookie(args, param, req, sess)
 	return args
 }
 
-func (ctx *HttpContext) newXMLArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger) IArgs {
+func (ctx *HttpContext) newXMLArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger, sess sessions.Session) IArgs {
 	t := reflect.TypeOf(iv).Elem()
 	v := reflect.New(t)
 	args, ok := v.Interface().(IArgs)
@@ -468,10 +503,13 @@ func (ctx *HttpContext) newXMLArgs(iv IArgs, req *http.Request, param martini.Pa
 	if martini.Env == martini.Dev {
 		log.Info("Recv XML:", string(data))
 	}
+	if err := args.PutSignBytes(data); err != nil {
+		log.Error(err)
+	}
 	if err := xml.Unmarshal(data, args); err != nil {
 		log.Error(err)
 	}
-	UnmarshalURLCookie(args, param, req)
+	UnmarshalURLCookie(args, param, req, sess)
 	return args
 }
 
@@ -554,6 +592,7 @@ func (ctx *HttpContext) useHttpHandler(method string, r martini.Router, url, vie
 	urls.View = view
 	urls.Render = render
 	urls.Args = args
+	urls.Authz = strings.Join(ctx.authzs, " ")
 	ctx.URLS = append(ctx.URLS, urls)
 }
 
@@ -584,17 +623,17 @@ func (ctx *HttpContext) GetArgsModel(args IArgs) interface{} {
 	}
 }
 
-func (ctx *HttpContext) newArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger) IArgs {
+func (ctx *HttpContext) newArgs(iv IArgs, req *http.Request, param martini.Params, log *logging.Logger, sess sessions.Session) IArgs {
 	var args IArgs = nil
 	switch iv.ReqType() {
 	case AT_URL:
-		args = ctx.newURLArgs(iv, req, param, log)
+		args = ctx.newURLArgs(iv, req, param, log, sess)
 	case AT_FORM:
-		args = ctx.newFormArgs(iv, req, param, log)
+		args = ctx.newFormArgs(iv, req, param, log, sess)
 	case AT_JSON:
-		args = ctx.newJSONArgs(iv, req, param, log)
+		args = ctx.newJSONArgs(iv, req, param, log, sess)
 	case AT_XML:
-		args = ctx.newXMLArgs(iv, req, param, log)
+		args = ctx.newXMLArgs(iv, req, param, log, sess)
 	default:
 		panic(errors.New("args reqtype error"))
 	}
@@ -655,38 +694,55 @@ func (ctx *HttpContext) domvccache(mvc IMVC, rv Render, m IModel, cp *CacheParam
 	}
 	//如果来自缓存并且符合预期得类型
 	if bc > 0 {
-		mt := m.Render()
-		if mt == JSON_RENDER {
-			cm := NewContentModel(bb, bc, cp.Key, ContentJSON)
-			mvc.SetModel(cm)
-			return nil, bc
-		}
-		if mt == XML_RENDER {
-			cm := NewContentModel(bb, bc, cp.Key, ContentXML)
-			mvc.SetModel(cm)
-			return nil, bc
-		}
-		if mt == TEXT_RENDER {
-			cm := NewContentModel(bb, bc, cp.Key, ContentText)
-			mvc.SetModel(cm)
-			return nil, bc
-		}
-		if mt == HTML_RENDER {
-			cm := NewContentModel(bb, bc, cp.Key, ContentHTML)
-			mvc.SetModel(cm)
-			return nil, bc
-		}
-		if mt == DATA_RENDER {
-			cm := NewContentModel(bb, bc, cp.Key, ContentBinary)
-			mvc.SetModel(cm)
-			return nil, bc
-		}
-		panic(fmt.Errorf(" type %d not support cache", mt))
+		ct := ""
+		switch mt := m.Render(); mt {
+		case JSON_RENDER:
+			ct = ContentJSON
+		case XML_RENDER:
+			ct = ContentXML
+		case TEXT_RENDER:
+			ct = ContentText
+		case HTML_RENDER:
+			ct = ContentHTML
+		case DATA_RENDER:
+			ct = ContentBinary
+		default:
+			panic(fmt.Errorf(" type %d not support cache", mt))
+		}
+		e := UnmarshalCacheEntry(bb)
+		if v := e.Header.Get(ContentType); v != "" {
+			ct = v
+			e.Header.Del(ContentType)
+		}
+		cm := NewContentModel(e.Body, bc, cp.Key, ct)
+		cm.Status = e.Status
+		for k, vs := range e.Header {
+			for _, v := range vs {
+				cm.Add(k, v)
+			}
+		}
+		cm.Set(HeaderCacheControl, cp.CacheControl())
+		cm.Set(HeaderLastModified, cp.ModTime().UTC().Format(http.TimeFormat))
+		mvc.SetModel(cm)
+		mvc.SetRender(CONTENT_RENDER)
+		return nil, bc
 	}
 	rv.CacheParams(cp)
 	return lck, bc
 }
 
+//中断处理并输出错误模型,xml参数输出xml,其他输出json
+func (ctx *HttpContext) abort(mvc IMVC, iv IArgs, status int, err error) {
+	m := NewHTTPError(status, err.Error())
+	mvc.SetStatus(status)
+	mvc.SetModel(m)
+	if iv != nil && iv.ReqType() == AT_XML {
+		mvc.SetRender(XML_RENDER)
+	} else {
+		mvc.SetRender(JSON_RENDER)
+	}
+}
+
 //检测是否跳过缓存
 func (ctx *HttpContext) checkskipcache(vs []reflect.Value, cp *CacheParams) {
 	if cp == nil || len(vs) != 1 {
@@ -696,20 +752,35 @@ func (ctx *HttpContext) checkskipcache(vs []reflect.Value, cp *CacheParams) {
 	cp.Skip(!vs[0].IsNil())
 }
 
-func (ctx *HttpContext) handlerWithArgs(iv IArgs, hv reflect.Value, dv reflect.Value, view string, render string) martini.Handler {
+func (ctx *HttpContext) handlerWithArgs(iv IArgs, hv reflect.Value, dv reflect.Value, view string, render string, signer ISigner) martini.Handler {
 	if !dv.IsValid() {
 		panic(errors.New("DefaultHandler miss"))
 	}
-	return func(c martini.Context, mvc IMVC, rv Render, param martini.Params, req *http.Request, log *logging.Logger) {
+	return func(c martini.Context, mvc IMVC, rv Render, param martini.Params, rw http.ResponseWriter, req *http.Request, log *logging.Logger) {
 		var err error
 		var vs []reflect.Value
 		var cp *CacheParams = nil
 		mvc.SetView(view)
 		mvc.SetRender(StringToRender(render))
-		args := ctx.newArgs(iv, req, param, log)
+		//请求体限制,Content-Length超过限制直接返回
+		bl := ctx.requestBodyLimit(c, rw, req)
+		if bl.err != nil {
+			ctx.abort(mvc, iv, http.StatusRequestEntityTooLarge, bl.err)
+			return
+		}
+		args := ctx.newArgs(iv, req, param, log, GetSession(c))
 		if args == nil {
 			panic(ErrorArgs)
 		}
+		//绑定时读取超过限制
+		if bl.err != nil {
+			ctx.abort(mvc, iv, http.StatusRequestEntityTooLarge, bl.err)
+			return
+		}
+		//csrf校验在请求体限制之后,使用绑定时已经解析的表单
+		if !ctx.checkCSRF(c, mvc, iv, req) {
+			return
+		}
 		//map args
 		c.Map(args)
 		model := args.Model()
@@ -724,6 +795,21 @@ func (ctx *HttpContext) handlerWithArgs(iv IArgs, hv reflect.Value, dv reflect.V
 			args.Validate(NewValidateModel(err), mvc)
 			return
 		}
+		//如果设置了签名数据 sha256,签名校验需要在缓存之前
+		//每个请求使用独立的签名状态,请求和响应分别计算
+		sp := signer
+		if sp == nil {
+			sp = UseSigner
+		}
+		if sp != nil {
+			sg := sp.New()
+			c.MapTo(sg, (*ISigner)(nil))
+			rv.Signer(sg)
+			if err := VerifyWithSigner(sg, req.Header, args.GetSignBytes(), req, 0); err != nil {
+				ctx.abort(mvc, iv, http.StatusUnauthorized, err)
+				return
+			}
+		}
 		//如果方法存在获取缓存处理,支持json，xml，string三种类型
 		if ch := ctx.GetArgsCacheParams(args); ch != nil {
 			//调用CacheParams
@@ -744,18 +830,6 @@ func (ctx *HttpContext) handlerWithArgs(iv IArgs, hv reflect.Value, dv reflect.V
 				defer lck.Release()
 			}
 		}
-		//如果设置了签名数据 sha256
-		if UseSigner != nil {
-			sbb := args.GetSignBytes()
-			sign := req.Header.Get(NF_Signature)
-			ts := req.Header.Get(NF_Timestamp)
-			nonce := req.Header.Get(NF_Nonce)
-			ads := []string{req.Host, req.Method, req.URL.Path}
-			err := UseSigner.Verify(sbb, sign, ts, nonce, ads...)
-			if err != nil {
-				panic(err)
-			}
-		}
 		//
 		if ah := ctx.GetArgsHandler(args); ah != nil {
 			vs, err = c.Invoke(ah)
@@ -808,11 +882,41 @@ func (ctx *HttpContext) useValue(pmethod string, r martini.Router, c IDispatcher
 		hv := sv.MethodByName(handler + HandlerSuffix)
 		dv := sv.MethodByName(DefaultHandler)
 		iv, ab := ctx.IsIArgs(v)
+		//认证和授权在其他处理之前执行
+		if auth := f.Tag.Get("auth"); auth != "" {
+			in = append(in, ctx.authHandler(auth, c, iv))
+		}
+		perms, roles := splitTag(f.Tag.Get("perm")), splitTag(f.Tag.Get("role"))
+		if len(perms) > 0 || len(roles) > 0 {
+			in = append(in, ctx.authzHandler(perms, roles, c, iv))
+		}
+		//限流在认证之后,可以按用户限流
+		//分组上的限流由分组下所有路由共享,路由上的限流每个路由独立
+		if limit := f.Tag.Get("limit"); limit != "" {
+			scope := ""
+			if d, b := ctx.IsIDispatcher(v); b {
+				scope = ctx.groupPath() + d.URL() + url
+			} else if !ab && v.Kind() == reflect.Struct {
+				scope = ctx.groupPath() + url
+			}
+			in = append(in, ctx.limitHandler(limit, scope, c, iv))
+		}
+		if csp := f.Tag.Get("csp"); csp != "" {
+			in = append(in, cspHandler(csp))
+		}
+		if maxbody := f.Tag.Get("maxbody"); maxbody != "" {
+			in = append(in, maxBodyHandler(maxbody))
+		}
+		//记录要求,子路由继承
+		authz := authzString(f)
+		if authz != "" {
+			ctx.authzs = append(ctx.authzs, authz)
+		}
 		if ab && url != "" {
 			if len(hs) > 0 {
 				in = ctx.useMulHandler(in, hs, sv)
 			}
-			in = append(in, ctx.handlerWithArgs(iv, hv, dv, view, render))
+			in = append(in, ctx.handlerWithArgs(iv, hv, dv, view, render, ctx.dispatcherSigner(c)))
 		}
 		if d, b := ctx.IsIDispatcher(v); b {
 			if len(hs) > 0 {
@@ -821,7 +925,7 @@ func (ctx *HttpContext) useValue(pmethod string, r martini.Router, c IDispatcher
 			if hv.IsValid() {
 				in = append(in, hv.Interface())
 			}
-			ctx.Group(d.URL()+url, func(r martini.Router) {
+			ctx.group(d.URL()+url, func(r martini.Router) {
 				ctx.useRouter(r, d)
 			}, in...)
 		} else if ab {
@@ -839,10 +943,13 @@ func (ctx *HttpContext) useValue(pmethod string, r martini.Router, c IDispatcher
 			if hv.IsValid() {
 				in = append(in, hv.Interface())
 			}
-			ctx.Group(url, func(r martini.Router) {
+			ctx.group(url, func(r martini.Router) {
 				ctx.useValue(method, r, c, v)
 			}, in...)
 		}
+		if authz != "" {
+			ctx.authzs = ctx.authzs[:len(ctx.authzs)-1]
+		}
 	}
 }
 
@@ -855,7 +962,19 @@ func (ctx *HttpContext) UseDispatcher(c IDispatcher, in ...martini.Handler) {
 	if b := c.BeforeHandler(); b != nil {
 		in = append(in, b)
 	}
-	ctx.Group(c.URL(), func(r martini.Router) {
+	ctx.group(c.URL(), func(r martini.Router) {
 		ctx.useRouter(r, c)
 	}, in...)
 }
+
+//注册分组并记录分组路径
+func (ctx *HttpContext) group(pattern string, fn func(martini.Router), in ...martini.Handler) {
+	ctx.groups = append(ctx.groups, pattern)
+	ctx.Group(pattern, fn, in...)
+	ctx.groups = ctx.groups[:len(ctx.groups)-1]
+}
+
+//当前注册的分组完整路径
+func (ctx *HttpContext) groupPath() string {
+	return strings.Join(ctx.groups, "")
+}